@@ -0,0 +1,235 @@
+package kane
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/aep/kane/kv"
+)
+
+// the compound, partial and func indexes of a model only have keys for documents written since they were declared.
+// a marker at
+//
+//	_ 0xff built 0xff <model> 0xff <name> 0xff
+//
+// tells that every document has them, which BuildIndexes sets after adding the keys to the older documents.
+// until then queries do not use the index. a model without documents has nothing to build,
+// so its indexes are marked as built when the model is first written or queried.
+
+func builtPath(model string, name string) []byte {
+	path := append([]byte{'_', 0xff}, "built"...)
+	path = append(path, 0xff)
+	path = append(path, model...)
+	path = append(path, 0xff)
+	path = append(path, name...)
+	return append(path, 0xff)
+}
+
+// BuildIndexes adds the keys of the compound, partial and func indexes of the models of docs to the documents
+// that were written before the indexes were declared, and then marks the indexes as built, see ModelSchema.
+// until then, queries do not use them, and fail with ErrNotIndexed on the name of a partial or func index.
+// like Verify with the Models and Repair options, it also repairs all other index keys of the models.
+// it can run while the database is in use, but every process writing the models must already declare the indexes.
+func (DB *DB) BuildIndexes(ctx context.Context, docs ...any) error {
+	for _, doc := range docs {
+		err := DB.buildIndexes(ctx, getModelFromAny(doc), docType(doc))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (DB *DB) buildIndexes(ctx context.Context, model string, typ reflect.Type) error {
+	schema, err := schemaOf(typ)
+	if err != nil {
+		return err
+	}
+	names := indexNames(schema)
+	if len(names) == 0 {
+		return nil
+	}
+
+	vt, err := DB.KV.GetVectorTime(ctx)
+	if err != nil {
+		return err
+	}
+	cutoff := kv.VectorTimeToTime(vt).Add(-DB.writeLockTimeout())
+
+	start := append([]byte{'k', 0xff}, model...)
+	start = append(start, 0xff)
+
+	var ptrs []kv.KeyAndValue
+	var busy [][]byte
+	for p, err := range DB.KV.Iter(ctx, start, prefixEnd(start)) {
+		if err != nil {
+			return err
+		}
+		if len(p.V) != 8 && len(p.V) != 16 {
+			continue
+		}
+		ptrs = append(ptrs, p)
+		if len(p.V) == 16 {
+			busy = append(busy, p.K)
+		}
+	}
+	if len(ptrs) > 0 {
+		_, err = DB.verifyModel(ctx, model, typ, ptrs, cutoff, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	// documents being written are skipped by Verify, and a write only adds the keys that its previous version
+	// should have had but did not, if the field changed. so they are built on their own once the write is done
+	policy := DB.retryPolicy(nil)
+	for n := 1; len(busy) > 0; n++ {
+		var still [][]byte
+		for _, pkpath := range busy {
+			err := DB.buildDocument(ctx, model, typ, pkpath)
+			if errors.Is(err, errLocked) {
+				still = append(still, pkpath)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		busy = still
+		if len(busy) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(policy.delay(n)):
+		}
+	}
+
+	for _, name := range names {
+		err := DB.KV.Set(ctx, builtPath(model, name), []byte{0xff})
+		if err != nil {
+			return err
+		}
+		DB.built.Store(model+"\xff"+name, struct{}{})
+	}
+	return nil
+}
+
+// buildDocument sets all index keys of the document at pkpath under its write lock
+func (DB *DB) buildDocument(ctx context.Context, model string, typ reflect.Type, pkpath []byte) error {
+	ptr, err := DB.KV.Get(ctx, pkpath)
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(ptr) != 8 && len(ptr) != 16 {
+		return nil
+	}
+	if len(ptr) == 16 && time.Since(kv.VectorTimeToTime(binary.LittleEndian.Uint64(ptr[8:]))) < DB.writeLockTimeout() {
+		return errLocked
+	}
+
+	oid := ptr[:8]
+	b, err := DB.KV.Get(ctx, objectPath(oid))
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := DB.derivedKeys(model, typ, oid, b)
+	if err != nil {
+		// a broken object has no keys
+		return nil
+	}
+
+	// checked again under the lock, in case the document changed since
+	return DB.repairDocument(ctx, model, typ, pkpath, oid, keys)
+}
+
+// builtIndexes tells for each compound, partial and func index of schema if it is built
+func (DB *DB) builtIndexes(ctx context.Context, model string, schema ModelSchema) (map[string]bool, error) {
+	names := indexNames(schema)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	built := make(map[string]bool, len(names))
+	var missing []string
+	for _, name := range names {
+		if _, ok := DB.built.Load(model + "\xff" + name); ok {
+			built[name] = true
+			continue
+		}
+		_, err := DB.KV.Get(ctx, builtPath(model, name))
+		if err == nil {
+			DB.built.Store(model+"\xff"+name, struct{}{})
+			built[name] = true
+			continue
+		}
+		if !errors.Is(err, kv.ErrNotFound) {
+			return nil, err
+		}
+		built[name] = false
+		missing = append(missing, name)
+	}
+	if len(missing) == 0 {
+		return built, nil
+	}
+
+	start := append([]byte{'k', 0xff}, model...)
+	start = append(start, 0xff)
+	for _, err := range DB.KV.IterKeys(ctx, start, prefixEnd(start)) {
+		if err != nil {
+			return nil, err
+		}
+		// there are documents that may not have the keys
+		return built, nil
+	}
+
+	for _, name := range missing {
+		err := DB.KV.Set(ctx, builtPath(model, name), []byte{0xff})
+		if err != nil {
+			return nil, err
+		}
+		DB.built.Store(model+"\xff"+name, struct{}{})
+		built[name] = true
+	}
+	return built, nil
+}
+
+// checkBuilt returns ErrNotIndexed if op or the order of q use the name of an index that is not built
+func checkBuilt(model string, op Filter, q queryOpts, built map[string]bool) error {
+	if len(built) == 0 {
+		return nil
+	}
+
+	if q.order != nil {
+		if ok, declared := built[q.order.key]; declared && !ok {
+			return fmt.Errorf("%w: %s index %q is not built, see BuildIndexes", ErrNotIndexed, model, q.order.key)
+		}
+	}
+
+	if op.op != filterScan {
+		for _, sub := range op.sub {
+			err := checkBuilt(model, sub, queryOpts{}, built)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if ok, declared := built[op.key]; declared && !ok {
+		return fmt.Errorf("%w: %s index %q is not built, see BuildIndexes", ErrNotIndexed, model, op.key)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/aep/kane"
@@ -133,6 +134,158 @@ var debugCmd = &cobra.Command{
 	},
 }
 
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "migrate index keys to the current format",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := kane.Init()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		ctx := context.Background()
+
+		version, err := db.IndexVersion(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading index version: %v\n", err)
+			os.Exit(1)
+		}
+
+		if version >= kane.IndexVersion {
+			fmt.Printf("Index is already at version %d\n", version)
+			return
+		}
+
+		if err := db.MigrateIndex(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Error migrating index: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Migrated index from version %d to %d\n", version, kane.IndexVersion)
+	},
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "delete objects and index keys left behind by crashed writes",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := kane.Init()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		horizon, _ := cmd.Flags().GetDuration("horizon")
+
+		opts := []kane.Opt{kane.Horizon(horizon)}
+		if dryRun {
+			opts = append(opts, kane.DryRun())
+		}
+
+		report, err := db.GC(context.Background(), opts...)
+		if report != nil {
+			for _, k := range report.Pointers {
+				fmt.Println(escapeNonPrintable(k))
+			}
+			for _, k := range report.Objects {
+				fmt.Println(escapeNonPrintable(k))
+			}
+			for _, k := range report.IndexKeys {
+				fmt.Println(escapeNonPrintable(k))
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error collecting garbage: %v\n", err)
+			os.Exit(1)
+		}
+
+		verb := "Deleted"
+		if dryRun {
+			verb = "Would delete"
+		}
+		fmt.Fprintf(os.Stderr, "%s %d pointers, %d objects and %d index keys\n",
+			verb, len(report.Pointers), len(report.Objects), len(report.IndexKeys))
+	},
+}
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "check the index against the stored documents",
+	Long: `check the index against the stored documents.
+without the Go types of the documents, their index keys are derived from the stored JSON,
+which differs for some fields, so keys of existing documents that seem to be missing or extra cannot be checked,
+and are only counted. --repair is only a partial repair:
+it deletes mis-encoded keys and keys of documents that no longer exist,
+but never adds missing keys or deletes extra keys of existing documents.
+those are checked and repaired by calling DB.Verify with the Models and Repair options from a program that has the types.
+exits with 1 if any wrong keys are left.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, err := kane.Init()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		repair, _ := cmd.Flags().GetBool("repair")
+
+		var opts []kane.Opt
+		if repair {
+			opts = append(opts, kane.Repair())
+		}
+
+		reports, err := db.Verify(context.Background(), opts...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying index: %v\n", err)
+			os.Exit(1)
+		}
+
+		models := make([]string, 0, len(reports))
+		for model := range reports {
+			models = append(models, model)
+		}
+		sort.Strings(models)
+
+		wrong := 0
+		for _, model := range models {
+			r := reports[model]
+			for _, k := range r.Missing {
+				fmt.Printf("missing %s\n", escapeNonPrintable(k))
+			}
+			for _, k := range r.Extra {
+				fmt.Printf("extra %s\n", escapeNonPrintable(k))
+			}
+			for _, k := range r.MisEncoded {
+				fmt.Printf("mis-encoded %s\n", escapeNonPrintable(k))
+			}
+			fmt.Fprintf(os.Stderr, "%s: %d documents, %d missing, %d extra and %d mis-encoded index keys, %d that cannot be checked\n",
+				model, r.Documents, len(r.Missing), len(r.Extra), len(r.MisEncoded), len(r.Unverified))
+			wrong += len(r.Missing) + len(r.Extra) + len(r.MisEncoded)
+		}
+
+		if repair && wrong > 0 {
+			// check again for what the partial repair left
+			reports, err = db.Verify(context.Background())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error verifying index: %v\n", err)
+				os.Exit(1)
+			}
+			wrong = 0
+			for _, r := range reports {
+				wrong += len(r.Missing) + len(r.Extra) + len(r.MisEncoded)
+			}
+			fmt.Fprintf(os.Stderr, "Deleted mis-encoded index keys and keys of deleted documents, %d wrong index keys are left\n", wrong)
+		}
+		if wrong > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
 func escapeNonPrintable(b []byte) string {
 	var result strings.Builder
 	for _, c := range b {
@@ -149,6 +302,14 @@ func init() {
 	rootCmd.AddCommand(debugCmd)
 	rootCmd.AddCommand(backupCmd)
 	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(migrateCmd)
+
+	gcCmd.Flags().Bool("dry-run", false, "only print what would be deleted")
+	gcCmd.Flags().Duration("horizon", kane.DefaultGCHorizon, "only delete garbage older than this")
+	rootCmd.AddCommand(gcCmd)
+
+	fsckCmd.Flags().Bool("repair", false, "partial repair, only delete mis-encoded index keys and keys of deleted documents")
+	rootCmd.AddCommand(fsckCmd)
 }
 
 func main() {
@@ -0,0 +1,300 @@
+package kane
+
+import (
+	"bytes"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// CompoundIndex indexes the values of several fields together, in order, see ModelSchema.
+// a query that is equal on its first fields, and has a range on or is ordered by the next one,
+// is answered by a single scan of it, instead of intersecting one scan per field.
+// the fields are still matched through their own index, so they have to be indexed too.
+// for fields with several values, like arrays, every combination of values is indexed.
+type CompoundIndex []string
+
+// key returns the name the compound index is stored as, in place of a field name
+func (c CompoundIndex) key() string {
+	return strings.Join(c, ",")
+}
+
+// multiIndex is a compound or partial index, which are written and scanned the same way
+type multiIndex struct {
+	key    string
+	fields []string
+
+	// where are the filters a document has to match to be in the index,
+	// which a query has to have too for the index to answer it
+	where []Filter
+}
+
+// multiIndexes returns the compound and partial indexes of schema
+func multiIndexes(schema ModelSchema) []multiIndex {
+	var indexes []multiIndex
+	for _, c := range schema.Compound {
+		indexes = append(indexes, multiIndex{key: c.key(), fields: c})
+	}
+	for _, p := range schema.Partial {
+		where, ok := whereLeaves(p.Where)
+		if !ok {
+			// maintained, but only found by its name
+			continue
+		}
+		indexes = append(indexes, multiIndex{key: p.Name, fields: p.Fields, where: where})
+	}
+	return indexes
+}
+
+// multiKeys returns the index keys of the values of fields of doc together, stored as key
+func multiKeys(doc *StoredDocument, key string, fields []string, path []byte, postfix []byte) [][]byte {
+	if strings.IndexByte(key, 0xff) >= 0 {
+		return nil
+	}
+
+	prefixes := [][]byte{append(append(bytes.Clone(path), key...), 0xff)}
+	for _, field := range fields {
+		var vals [][]byte
+		valuesAt(reflect.ValueOf(doc.Val), strings.Split(field, "."), &vals)
+
+		var next [][]byte
+		for _, p := range prefixes {
+			for _, v := range vals {
+				next = append(next, append(bytes.Clone(p), v...))
+			}
+		}
+		prefixes = next
+	}
+
+	keys := make([][]byte, len(prefixes))
+	for i, p := range prefixes {
+		keys[i] = append(p, postfix...)
+	}
+	return keys
+}
+
+// valuesAt collects the encoded values at path of v, like indexI would index them
+func valuesAt(v reflect.Value, path []string, vals *[][]byte) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	if (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Type().Elem().Kind() != reflect.Uint8 {
+		for i := 0; i < v.Len(); i++ {
+			valuesAt(v.Index(i), path, vals)
+		}
+		return
+	}
+
+	if len(path) == 0 {
+		if !v.CanInterface() {
+			return
+		}
+		vbin, err := indexVal(v.Interface())
+		if err == nil {
+			*vals = append(*vals, vbin)
+		}
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return
+		}
+		mv := v.MapIndex(reflect.ValueOf(path[0]).Convert(v.Type().Key()))
+		if mv.IsValid() {
+			valuesAt(mv, path[1:], vals)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := jsonFieldName(t.Field(i))
+			if ok && name == path[0] {
+				valuesAt(v.Field(i), path[1:], vals)
+				return
+			}
+		}
+	}
+}
+
+// leafValue returns the encoded value of a filter from Eq, without the field prefix and terminator
+func leafValue(op Filter) []byte {
+	prefix, _ := fieldPrefix(op.key)
+	return op.start[len(prefix) : len(op.start)-1]
+}
+
+// isLeaf tells if op is a single scan of the index of key
+func isLeaf(op Filter, key string) bool {
+	return op.err == nil && op.op == filterScan && op.key == key && op.start != nil
+}
+
+// sameLeaf tells if a and b are the same scan
+func sameLeaf(a Filter, b Filter) bool {
+	return isLeaf(a, b.key) && a.exact == b.exact && bytes.Equal(a.start, b.start) && bytes.Equal(a.end, b.end)
+}
+
+// multiScan returns the scan of ix for the filters ops, and which of ops it answers.
+// if order is not empty, it has to be the field after the ones ops are equal on.
+func multiScan(ix multiIndex, ops []Filter, order string) (Filter, []int, bool) {
+	prefix, err := fieldPrefix(ix.key)
+	if err != nil {
+		return Filter{}, nil, false
+	}
+
+	var used []int
+	for _, w := range ix.where {
+		j := slices.IndexFunc(ops, func(op Filter) bool { return sameLeaf(op, w) })
+		if j < 0 {
+			return Filter{}, nil, false
+		}
+		used = append(used, j)
+	}
+
+	start := prefix
+
+fields:
+	for i, field := range ix.fields {
+		for j, op := range ops {
+			if isLeaf(op, field) && op.exact {
+				start = append(start, leafValue(op)...)
+				used = append(used, j)
+				continue fields
+			}
+		}
+
+		if order != "" && field != order {
+			return Filter{}, nil, false
+		}
+
+		// a range of the first field not equal to a single value, and then nothing more.
+		// on the first field of a compound index, that is what the index of the field is for
+		for j, op := range ops {
+			if isLeaf(op, field) {
+				fprefix, _ := fieldPrefix(field)
+				used = append(used, j)
+				scan := Filter{
+					key:   ix.key,
+					start: append(bytes.Clone(start), op.start[len(fprefix):]...),
+				}
+				if len(op.end) > len(fprefix) {
+					scan.end = append(bytes.Clone(start), op.end[len(fprefix):]...)
+				} else {
+					// Has, which is any value
+					scan.end = prefixEnd(start)
+				}
+				return scan, used, i > 0 || len(ix.where) > 0
+			}
+		}
+
+		if len(used) == 0 {
+			return Filter{}, nil, false
+		}
+		return Filter{
+			key:   ix.key,
+			start: start,
+			end:   prefixEnd(start),
+		}, used, true
+	}
+
+	if order != "" {
+		// the order field is not part of the index
+		return Filter{}, nil, false
+	}
+
+	// equal on all fields, so keys only differ by id like for Eq
+	start = append(start, 0xff)
+	return Filter{
+		key:   ix.key,
+		start: start,
+		end:   prefixEnd(start),
+		exact: true,
+	}, used, true
+}
+
+// planCompound replaces the filters of And that a compound or partial index answers with a scan of it
+func planCompound(indexes []multiIndex, op Filter) Filter {
+	if len(indexes) == 0 || op.err != nil {
+		return op
+	}
+	if op.op == filterScan {
+		// only a partial index can answer a single filter better than the index of its field,
+		// and only with a scan that is sorted by id, which finds every document once, and is continued by id like Eq
+		for _, ix := range indexes {
+			scan, _, ok := multiScan(ix, []Filter{op}, "")
+			if ok && len(ix.where) > 0 && scan.exact {
+				return scan
+			}
+		}
+		return op
+	}
+
+	subs := make([]Filter, len(op.sub))
+	for i, sub := range op.sub {
+		if op.op == filterAnd && sub.op == filterScan {
+			// planned together below
+			subs[i] = sub
+			continue
+		}
+		subs[i] = planCompound(indexes, sub)
+	}
+	if op.op != filterAnd {
+		return Filter{op: op.op, sub: subs}
+	}
+
+	// a compound index used for a single field is no better than the index of the field
+	var best Filter
+	var bestUsed []int
+	for _, ix := range indexes {
+		scan, used, ok := multiScan(ix, subs, "")
+		if ok && (len(used) >= 2 || len(ix.where) > 0) && len(used) > len(bestUsed) {
+			best, bestUsed = scan, used
+		}
+	}
+	if bestUsed == nil {
+		return Filter{op: filterAnd, sub: subs}
+	}
+
+	rest := []Filter{best}
+	for i, sub := range subs {
+		if !slices.Contains(bestUsed, i) {
+			rest = append(rest, sub)
+		}
+	}
+	return Filter{op: filterAnd, sub: rest}
+}
+
+// orderedCompound returns the scan of a compound or partial index that yields the documents matching op
+// in the order of key, and the filters of op it does not answer
+func orderedCompound(indexes []multiIndex, op Filter, key string) (Filter, []Filter, bool) {
+	if op.err != nil {
+		return Filter{}, nil, false
+	}
+	ops := []Filter{op}
+	if op.op == filterAnd {
+		ops = op.sub
+	}
+
+	var best Filter
+	var bestUsed []int
+	for _, ix := range indexes {
+		scan, used, ok := multiScan(ix, ops, key)
+		if ok && len(used) > len(bestUsed) {
+			best, bestUsed = scan, used
+		}
+	}
+	if bestUsed == nil {
+		return Filter{}, nil, false
+	}
+
+	var rest []Filter
+	for i, sub := range ops {
+		if !slices.Contains(bestUsed, i) {
+			rest = append(rest, sub)
+		}
+	}
+	return best, rest, true
+}
@@ -0,0 +1,255 @@
+package kane
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type CompoundTestDoc struct {
+	ID     string
+	UserID string
+	Order  int
+	Done   bool
+	Tags   []string `kane:"noindex"`
+}
+
+func (d CompoundTestDoc) PK() any {
+	return d.ID
+}
+
+func (d *CompoundTestDoc) Schema() ModelSchema {
+	return ModelSchema{
+		Compound: []CompoundIndex{
+			{"UserID", "Order"},
+			{"UserID", "Done", "Order"},
+		},
+	}
+}
+
+func TestCompound(t *testing.T) {
+	schema, _ := schemaOf(docType(CompoundTestDoc{}))
+	compound := multiIndexes(schema)
+
+	t.Run("Plan", func(t *testing.T) {
+		op := planCompound(compound, And(Eq("UserID", "bob"), Gte("Order", 2), Has("ID")))
+		if op.op != filterAnd || len(op.sub) != 2 || op.sub[0].key != "UserID,Order" || op.sub[1].key != "ID" {
+			t.Errorf("Expected a scan of UserID,Order and ID, got %+v", op)
+		}
+
+		op = planCompound(compound, And(Eq("UserID", "bob"), Eq("Done", false), Eq("Order", 1)))
+		if len(op.sub) != 1 || op.sub[0].key != "UserID,Done,Order" || !op.sub[0].exact {
+			t.Errorf("Expected an exact scan of UserID,Done,Order, got %+v", op)
+		}
+
+		// a range on the first field is what its own index is for
+		op = planCompound(compound, And(Gte("UserID", "bob"), Eq("Order", 1)))
+		if len(op.sub) != 2 || op.sub[0].key != "UserID" {
+			t.Errorf("Expected no compound scan, got %+v", op)
+		}
+
+		scan, rest, ok := orderedCompound(compound, And(Eq("UserID", "bob"), Eq("Done", false)), "Order")
+		if !ok || scan.key != "UserID,Done,Order" || len(rest) != 0 {
+			t.Errorf("Expected ordered scan of UserID,Done,Order, got %+v %+v", scan, rest)
+		}
+	})
+
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		var docs []*CompoundTestDoc
+		for i, user := range []string{"alice", "bob", "bob", "bob", "carol", "bob"} {
+			doc := &CompoundTestDoc{
+				ID:     fmt.Sprintf("compound-test-%d", i),
+				UserID: user,
+				Order:  (i * 7) % 5,
+				Done:   i%2 == 0,
+				Tags:   []string{"a", "b"},
+			}
+			if err := db.Put(ctx, doc); err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			docs = append(docs, doc)
+		}
+
+		// bob has 1:2 2:4 3:1 5:0
+		ids := func(t *testing.T, op Filter, opts ...Opt) []string {
+			var ids []string
+			for doc, err := range Iter[CompoundTestDoc](ctx, db, op, opts...) {
+				if err != nil {
+					t.Fatalf("Failed to iterate: %v", err)
+				}
+				ids = append(ids, doc.ID)
+			}
+			return ids
+		}
+
+		t.Run("Build", func(t *testing.T) {
+			// as if the first documents were written before the index was declared
+			prefix := []byte("f\xffCompoundTestDoc\xff.UserID,Order\xff")
+			var keys [][]byte
+			for k, err := range db.KV.IterKeys(ctx, prefix, prefixEnd(prefix)) {
+				if err != nil {
+					t.Fatalf("Failed to iterate keys: %v", err)
+				}
+				keys = append(keys, k)
+			}
+			for _, k := range keys[:3] {
+				db.KV.Del(ctx, k)
+			}
+			db.KV.Del(ctx, builtPath("CompoundTestDoc", "UserID,Order"))
+			db.built.Delete("CompoundTestDoc\xffUserID,Order")
+
+			// not used until it is built
+			built, err := db.builtIndexes(ctx, "CompoundTestDoc", ModelSchema{Compound: []CompoundIndex{{"UserID", "Order"}}})
+			if err != nil || built["UserID,Order"] {
+				t.Errorf("Expected index not to be built, got %v %v", built, err)
+			}
+			got := ids(t, Eq("UserID", "bob"), OrderBy("Order", Asc))
+			if !slices.Equal(got, []string{"compound-test-5", "compound-test-3", "compound-test-1", "compound-test-2"}) {
+				t.Errorf("Expected bob's todos by order before the build, got %v", got)
+			}
+
+			if err := db.BuildIndexes(ctx, CompoundTestDoc{}); err != nil {
+				t.Fatalf("Failed to build indexes: %v", err)
+			}
+			n := 0
+			for _, err := range db.KV.IterKeys(ctx, prefix, prefixEnd(prefix)) {
+				if err != nil {
+					t.Fatalf("Failed to iterate keys: %v", err)
+				}
+				n++
+			}
+			if n != len(keys) {
+				t.Errorf("Expected %d compound keys after the build, got %d", len(keys), n)
+			}
+			built, err = db.builtIndexes(ctx, "CompoundTestDoc", ModelSchema{Compound: []CompoundIndex{{"UserID", "Order"}}})
+			if err != nil || !built["UserID,Order"] {
+				t.Errorf("Expected index to be built, got %v %v", built, err)
+			}
+		})
+
+		t.Run("Keys", func(t *testing.T) {
+			keys, err := db.indexKeys(&StoredDocument{Val: docs[1]}, []byte("CompoundTestDoc"), []byte("12345678"))
+			if err != nil {
+				t.Fatalf("Failed to get index keys: %v", err)
+			}
+			user, _ := indexVal("bob")
+			order, _ := indexVal(2)
+			want := append([]byte("f\xffCompoundTestDoc\xff.UserID,Order\xff"), user...)
+			want = append(append(want, order...), "\xff12345678\xff"...)
+			if !slices.ContainsFunc(keys, func(k []byte) bool { return string(k) == string(want) }) {
+				t.Errorf("Expected compound key %q", want)
+			}
+		})
+
+		t.Run("Range", func(t *testing.T) {
+			got := ids(t, And(Eq("UserID", "bob"), Gte("Order", 2)))
+			slices.Sort(got)
+			if !slices.Equal(got, []string{"compound-test-1", "compound-test-2"}) {
+				t.Errorf("Expected bob's todos from order 2, got %v", got)
+			}
+
+			n, err := db.Count(ctx, CompoundTestDoc{}, And(Eq("UserID", "bob"), Eq("Done", false), Lt("Order", 2)))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if n != 2 {
+				t.Errorf("Expected 2 open todos of bob before order 2, got %d", n)
+			}
+		})
+
+		t.Run("Ordered", func(t *testing.T) {
+			got := ids(t, Eq("UserID", "bob"), OrderBy("Order", Asc))
+			if !slices.Equal(got, []string{"compound-test-5", "compound-test-3", "compound-test-1", "compound-test-2"}) {
+				t.Errorf("Expected bob's todos by order, got %v", got)
+			}
+
+			got = ids(t, And(Eq("UserID", "bob"), Eq("Done", false)), OrderBy("Order", Desc))
+			if !slices.Equal(got, []string{"compound-test-1", "compound-test-3", "compound-test-5"}) {
+				t.Errorf("Expected bob's open todos by order descending, got %v", got)
+			}
+
+			var cursor string
+			var pages []string
+			for range 5 {
+				for doc, err := range Iter[CompoundTestDoc](ctx, db, Eq("UserID", "bob"), OrderBy("Order", Asc), Limit(2), Cursor(&cursor)) {
+					if err != nil {
+						t.Fatalf("Failed to iterate: %v", err)
+					}
+					pages = append(pages, doc.ID)
+				}
+				if cursor == "" {
+					break
+				}
+			}
+			if !slices.Equal(pages, []string{"compound-test-5", "compound-test-3", "compound-test-1", "compound-test-2"}) {
+				t.Errorf("Expected pages of bob's todos by order, got %v", pages)
+			}
+		})
+
+		t.Run("Update", func(t *testing.T) {
+			docs[5].Order = 9
+			if err := db.Set(ctx, docs[5]); err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+			got := ids(t, Eq("UserID", "bob"), OrderBy("Order", Asc))
+			if !slices.Equal(got, []string{"compound-test-3", "compound-test-1", "compound-test-2", "compound-test-5"}) {
+				t.Errorf("Expected moved todo last, got %v", got)
+			}
+
+			got = ids(t, And(Eq("UserID", "bob"), Eq("Order", 0)))
+			if len(got) != 0 {
+				t.Errorf("Expected old compound key to be gone, got %v", got)
+			}
+		})
+
+		t.Run("DelByValue", func(t *testing.T) {
+			if err := db.Del(ctx, CompoundTestDoc{ID: docs[1].ID}); err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+			got := ids(t, And(Eq("UserID", "bob"), Gte("Order", 0)))
+			slices.Sort(got)
+			if !slices.Equal(got, []string{"compound-test-2", "compound-test-3", "compound-test-5"}) {
+				t.Errorf("Expected the compound keys of the deleted todo to be gone, got %v", got)
+			}
+		})
+
+		for _, doc := range docs {
+			db.Del(ctx, doc)
+		}
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-compound-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
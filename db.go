@@ -1,14 +1,30 @@
 package kane
 
 import (
+	"context"
 	"net/url"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/aep/kane/kv"
 )
 
 type DB struct {
 	kv.KV
+
+	// RetryPolicy is used for all writes that do not pass the Retry option. nil uses DefaultRetryPolicy
+	RetryPolicy *RetryPolicy
+
+	// WriteLockTimeout is how long a write may hold the lock of a primary key before other writes take it over.
+	// writes give up after half of it. 0 uses DefaultWriteLockTimeout.
+	// all processes writing to the same database must use the same timeout
+	WriteLockTimeout time.Duration
+
+	stats stats
+
+	// model 0xff name of the indexes that are known to be built, see BuildIndexes
+	built sync.Map
 }
 
 func Init(connect ...string) (*DB, error) {
@@ -37,7 +53,14 @@ func Init(connect ...string) (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{KV: k}, nil
+	db := &DB{KV: k}
+	err = db.initIndexVersion(context.Background())
+	if err != nil {
+		k.Close()
+		return nil, err
+	}
+
+	return db, nil
 }
 
 func (db *DB) Close() {
@@ -14,6 +14,9 @@ type Document interface {
 type StoredDocument struct {
 	Val     any      `json:"val"`
 	History *History `json:"history,omitempty"`
+
+	// Version identifies the stored content. it changes on every write, see DB.Update
+	Version uint64 `json:"version,omitempty"`
 }
 
 type History struct {
@@ -26,12 +29,28 @@ func getPKFromAny(val any) ([]byte, error) {
 		val = sdoc.Val
 	}
 	if doc, ok := val.(Document); ok {
-		return indexVal(doc.PK())
+		// k keys are never migrated, see indexValV1
+		pk, err := indexValV1(doc.PK())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		return pk, nil
 	}
 
 	return nil, fmt.Errorf("%T does not implement kane.Document: missing PK()", val)
 }
 
+// pkOf returns the primary key of a document for error messages, or nil
+func pkOf(val any) any {
+	if sdoc, ok := val.(*StoredDocument); ok {
+		val = sdoc.Val
+	}
+	if doc, ok := val.(Document); ok {
+		return doc.PK()
+	}
+	return nil
+}
+
 func getModelFromAny(val any) string {
 	if doc, ok := val.(StoredDocument); ok {
 		return getModelFromAny(doc.Val)
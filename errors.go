@@ -0,0 +1,66 @@
+package kane
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aep/kane/kv"
+)
+
+var (
+	// ErrNotFound is returned when no document matches. it is the same error as kv.ErrNotFound
+	ErrNotFound = kv.ErrNotFound
+
+	// ErrConflict is returned when a write lost against a concurrent write of the same primary key
+	ErrConflict = errors.New("conflict")
+
+	// ErrInvalidKey is returned for model names, field names and primary keys that cannot be stored
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrNotIndexed is returned for queries on fields that are not indexed, see Schema
+	ErrNotIndexed = errors.New("not indexed")
+
+	// ErrUnique is returned, wrapped in a UniqueError, for writes that would give a field tagged
+	// kane:"unique" a value that another document already has
+	ErrUnique = errors.New("not unique")
+)
+
+// docError wraps err with the model and primary key of the document it is about
+func docError(err error, model string, pk any) error {
+	if pk == nil {
+		return fmt.Errorf("%s: %w", model, err)
+	}
+	return fmt.Errorf("%s %v: %w", model, pk, err)
+}
+
+// ObjectError is returned by Iter for a document that was found in the index but could not be loaded.
+// Err is ErrNotFound if the object is missing, or the decoding error if it is corrupt.
+// an object is also missing for the index keys left behind by a create that crashed, until GC collects them.
+type ObjectError struct {
+	Model string
+	ID    []byte
+	Err   error
+}
+
+func (e *ObjectError) Error() string {
+	return fmt.Sprintf("%s object %x: %v", e.Model, e.ID, e.Err)
+}
+
+func (e *ObjectError) Unwrap() error {
+	return e.Err
+}
+
+// UniqueError is returned by writes that would give the field tagged kane:"unique" a value
+// that another document of the model already has.
+type UniqueError struct {
+	Model string
+	Field string
+}
+
+func (e *UniqueError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Model, e.Field, ErrUnique)
+}
+
+func (e *UniqueError) Unwrap() error {
+	return ErrUnique
+}
@@ -5,20 +5,39 @@ import (
 	"context"
 	"fmt"
 	"iter"
+	"reflect"
+	"sort"
+
+	"github.com/aep/kane/kv"
 )
 
 type Filter struct {
 	err error
 
+	key   string
 	start []byte
 	end   []byte
+
+	// the scan yields ids in sorted order, which is true for a single value
+	exact bool
+
+	op  filterOp
+	sub []Filter
 }
 
+type filterOp int
+
+const (
+	filterScan filterOp = iota
+	filterAnd
+	filterOr
+	filterNot
+)
+
 func Eq(key string, val any) Filter {
-	for _, ch := range key {
-		if ch == 0xff {
-			return Filter{err: fmt.Errorf("invalid key: cannot contain 0xff")}
-		}
+	prefix, err := fieldPrefix(key)
+	if err != nil {
+		return Filter{err: err}
 	}
 
 	valb, err := indexVal(val)
@@ -26,76 +45,761 @@ func Eq(key string, val any) Filter {
 		return Filter{err: err}
 	}
 
-	start := append([]byte{'.'}, key...)
-	start = append(start, 0xff)
-	start = append(start, valb...)
+	start := append(prefix, valb...)
 	start = append(start, 0xff)
-	start = append(start, 0x00)
-	end := bytes.Clone(start)
-	end[len(end)-1] = 0xff
 
 	return Filter{
+		key:   key,
 		start: start,
-		end:   end,
+		end:   prefixEnd(start),
+		exact: true,
 	}
 }
 
 func Has(key string) Filter {
-	for _, ch := range key {
-		if ch == 0xff {
-			return Filter{err: fmt.Errorf("invalid key: cannot contain 0xff")}
+	prefix, err := fieldPrefix(key)
+	if err != nil {
+		return Filter{err: err}
+	}
+
+	return Filter{
+		key:   key,
+		start: prefix,
+		end:   prefixEnd(prefix),
+	}
+}
+
+// matches documents where key is a string starting with prefix
+func Prefix(key string, prefix string) Filter {
+	fprefix, err := fieldPrefix(key)
+	if err != nil {
+		return Filter{err: err}
+	}
+
+	valb, err := indexVal(prefix)
+	if err != nil {
+		return Filter{err: err}
+	}
+
+	// without the terminator, the encoding of prefix is a prefix of the encoding of any string starting with it
+	start := append(fprefix, valb[:len(valb)-1]...)
+
+	return Filter{
+		key:   key,
+		start: start,
+		end:   prefixEnd(start),
+	}
+}
+
+// matches documents where key is equal to any of vals
+func In(key string, vals ...any) Filter {
+	ops := make([]Filter, len(vals))
+	for i, val := range vals {
+		ops[i] = Eq(key, val)
+	}
+	return Or(ops...)
+}
+
+// matches documents where key is strictly greater than val
+func Gt(key string, val any) Filter {
+	return rangeFilter(key, val, false, nil, false)
+}
+
+// matches documents where key is greater than or equal to val
+func Gte(key string, val any) Filter {
+	return rangeFilter(key, val, true, nil, false)
+}
+
+// matches documents where key is strictly less than val
+func Lt(key string, val any) Filter {
+	return rangeFilter(key, nil, false, val, false)
+}
+
+// matches documents where key is less than or equal to val
+func Lte(key string, val any) Filter {
+	return rangeFilter(key, nil, false, val, true)
+}
+
+// matches documents where key is within lo and hi, both inclusive
+func Between(key string, lo any, hi any) Filter {
+	return rangeFilter(key, lo, true, hi, true)
+}
+
+// rangeFilter scans the index of key between lo and hi. a nil bound is open.
+// values of a different type than the bounds are never matched,
+// so Gt("Age", 10) will not return documents where Age is a string.
+func rangeFilter(key string, lo any, loInclusive bool, hi any, hiInclusive bool) Filter {
+	prefix, err := fieldPrefix(key)
+	if err != nil {
+		return Filter{err: err}
+	}
+
+	var lob, hib []byte
+	if lo != nil {
+		lob, err = indexVal(lo)
+		if err != nil {
+			return Filter{err: err}
+		}
+	}
+	if hi != nil {
+		hib, err = indexVal(hi)
+		if err != nil {
+			return Filter{err: err}
 		}
 	}
 
-	start := append([]byte{'.'}, key...)
-	start = append(start, 0xff)
-	start = append(start, 0x00)
-	end := bytes.Clone(start)
-	end[len(end)-1] = 0xff
+	var typ byte
+	switch {
+	case lob != nil && hib != nil:
+		if lob[0] != hib[0] {
+			return Filter{err: fmt.Errorf("range bounds %T and %T are not comparable", lo, hi)}
+		}
+		typ = lob[0]
+	case lob != nil:
+		typ = lob[0]
+	case hib != nil:
+		typ = hib[0]
+	default:
+		return Filter{err: fmt.Errorf("range on %s needs at least one bound", key)}
+	}
+
+	var start, end []byte
+
+	if lob == nil {
+		start = append(bytes.Clone(prefix), typ)
+	} else if loInclusive {
+		start = append(bytes.Clone(prefix), lob...)
+	} else {
+		start = prefixEnd(append(bytes.Clone(prefix), lob...))
+	}
+
+	if hib == nil {
+		end = append(bytes.Clone(prefix), typ+1)
+	} else if hiInclusive {
+		end = prefixEnd(append(bytes.Clone(prefix), hib...))
+	} else {
+		end = append(bytes.Clone(prefix), hib...)
+	}
 
 	return Filter{
+		key:   key,
 		start: start,
 		end:   end,
 	}
 }
 
-func (DB *DB) find(ctx context.Context, model string, op Filter) iter.Seq2[[]byte, error] {
-	for _, ch := range model {
+// matches documents that match all of the filters
+func And(ops ...Filter) Filter {
+	return Filter{op: filterAnd, sub: ops}
+}
+
+// matches documents that match any of the filters
+func Or(ops ...Filter) Filter {
+	return Filter{op: filterOr, sub: ops}
+}
+
+// matches documents that do not match the filter.
+// on its own this has to scan every document of the model, so prefer using it inside And
+func Not(op Filter) Filter {
+	return Filter{op: filterNot, sub: []Filter{op}}
+}
+
+func fieldPrefix(key string) ([]byte, error) {
+	if bytes.IndexByte([]byte(key), 0xff) >= 0 {
+		return nil, fmt.Errorf("%w: %q cannot contain 0xff", ErrInvalidKey, key)
+	}
+
+	prefix := append([]byte{'.'}, key...)
+	prefix = append(prefix, 0xff)
+	return prefix, nil
+}
+
+// prefixEnd returns the smallest key that is larger than every key starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for len(end) > 0 {
+		if end[len(end)-1] != 0xff {
+			end[len(end)-1]++
+			return end
+		}
+		end = end[:len(end)-1]
+	}
+	return nil
+}
+
+// hit is an id found in the index.
+// pos is where the scan that found it is at, so that a later scan can continue after it.
+// for results sorted by id, pos is the id.
+// key is the index key it was found at.
+type hit struct {
+	id  []byte
+	pos []byte
+	key []byte
+}
+
+type hits = iter.Seq2[hit, error]
+
+func failed(err error) hits {
+	return func(yield func(hit, error) bool) {
+		yield(hit{}, err)
+	}
+}
+
+// find yields the ids of documents of model matching op, each once.
+// typ is the struct type of the documents, if known, to reject queries on fields that are not indexed.
+// if after is not nil, it is the pos of a hit of a previous run of the same query to continue after.
+func (DB *DB) find(ctx context.Context, model string, typ reflect.Type, op Filter, q queryOpts, after []byte) hits {
+	for _, ch := range []byte(model) {
 		if ch == 0xff {
-			return func(yield func([]byte, error) bool) {
-				yield(nil, fmt.Errorf("invalid key: cannot contain 0xff"))
+			return failed(fmt.Errorf("%w: %q cannot contain 0xff", ErrInvalidKey, model))
+		}
+	}
+
+	schema, err := schemaOf(typ)
+	if err != nil {
+		return failed(err)
+	}
+	err = checkIndexed(model, typ, op, q)
+	if err != nil {
+		return failed(err)
+	}
+
+	// indexes declared after documents were written are only used once they are built
+	built, err := DB.builtIndexes(ctx, model, schema)
+	if err != nil {
+		return failed(err)
+	}
+	err = checkBuilt(model, op, q, built)
+	if err != nil {
+		return failed(err)
+	}
+	var compound []multiIndex
+	for _, ix := range multiIndexes(schema) {
+		if ok, declared := built[ix.key]; ok || !declared {
+			compound = append(compound, ix)
+		}
+	}
+
+	if q.order != nil {
+		return DB.findOrdered(ctx, model, compound, op, *q.order, after)
+	}
+	op = planCompound(compound, op)
+
+	// a scan that is not sorted by id finds a document once for every value it has in range, like array elements
+	ids, sorted := DB.findOp(ctx, model, op, after)
+	if !sorted {
+		return dedup(ids)
+	}
+	return ids
+}
+
+// findOp returns the ids matching op and whether they are sorted
+func (DB *DB) findOp(ctx context.Context, model string, op Filter, after []byte) (hits, bool) {
+	if op.err != nil {
+		return failed(op.err), false
+	}
+
+	switch op.op {
+	case filterAnd:
+		return DB.findAnd(ctx, model, op.sub, after)
+	case filterOr:
+		return DB.findOr(ctx, model, op.sub, after)
+	case filterNot:
+		return DB.findAnd(ctx, model, []Filter{op}, after)
+	}
+
+	if !op.exact {
+		return DB.scan(ctx, model, op.start, op.end, false, after), false
+	}
+
+	// all keys of a single value only differ by id, so the id is enough to continue
+	var afterKey []byte
+	if after != nil {
+		afterKey = append(indexPrefix(model), op.start...)
+		afterKey = append(afterKey, after...)
+		afterKey = append(afterKey, 0xff)
+	}
+	return func(yield func(hit, error) bool) {
+		for h, err := range DB.scan(ctx, model, op.start, op.end, false, afterKey) {
+			if !yield(hit{id: h.id, pos: h.id, key: h.key}, err) {
+				return
+			}
+		}
+	}, true
+}
+
+// findOrdered walks the index of the field to order by and only yields ids that also match op
+func (DB *DB) findOrdered(ctx context.Context, model string, compound []multiIndex, op Filter, order orderBy, after []byte) hits {
+	prefix, err := fieldPrefix(order.key)
+	if err != nil {
+		return failed(err)
+	}
+	if op.err != nil {
+		return failed(op.err)
+	}
+	desc := order.dir == Desc
+
+	// a filter on the same field is just a narrower scan of the same index
+	if op.op == filterScan && op.key == order.key {
+		return dedup(DB.scan(ctx, model, op.start, op.end, desc, after))
+	}
+
+	// and so is a compound index that is equal on the fields before the one to order by
+	start, end := prefix, prefixEnd(prefix)
+	if scan, rest, ok := orderedCompound(compound, op, order.key); ok {
+		if len(rest) == 0 {
+			return dedup(DB.scan(ctx, model, scan.start, scan.end, desc, after))
+		}
+		start, end = scan.start, scan.end
+		op = And(rest...)
+	}
+	op = planCompound(compound, op)
+
+	return func(yield func(hit, error) bool) {
+		ids, _ := DB.findOp(ctx, model, op, nil)
+		matching, err := collectIds(ids)
+		if err != nil {
+			yield(hit{}, err)
+			return
+		}
+
+		for h, err := range dedup(DB.scan(ctx, model, start, end, desc, after)) {
+			if err != nil {
+				yield(hit{}, err)
+				return
+			}
+			if _, ok := matching[string(h.id)]; !ok {
+				continue
+			}
+			if !yield(h, nil) {
+				return
 			}
 		}
 	}
+}
 
-	start := append([]byte{'f', 0xff}, model...)
+// matches tells if a document with the index keys keys, starting with prefix, matches op
+// the same way find would
+func (op Filter) matches(prefix []byte, keys [][]byte) bool {
+	switch op.op {
+	case filterAnd:
+		for _, sub := range op.sub {
+			if !sub.matches(prefix, keys) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, sub := range op.sub {
+			if sub.matches(prefix, keys) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return !op.sub[0].matches(prefix, keys)
+	}
+
+	for _, k := range keys {
+		if !bytes.HasPrefix(k, prefix) {
+			continue
+		}
+		k = k[len(prefix):]
+		if bytes.Compare(k, op.start) >= 0 && (op.end == nil || bytes.Compare(k, op.end) < 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func indexPrefix(model string) []byte {
+	prefix := append([]byte{'f', 0xff}, model...)
+	return append(prefix, 0xff)
+}
+
+// scan yields the ids of the index keys of model between start and end.
+// the pos of each hit is its index key.
+func (DB *DB) scan(ctx context.Context, model string, start []byte, end []byte, desc bool, after []byte) hits {
+	mstart := append(indexPrefix(model), start...)
+	mend := append(indexPrefix(model), end...)
+
+	var opts []kv.Opt
+	if desc {
+		opts = append(opts, kv.Reverse{})
+	}
+
+	// continue after a previous scan, but never leave the range
+	if after != nil {
+		if desc && bytes.Compare(after, mend) < 0 {
+			mend = bytes.Clone(after)
+		}
+		if !desc && bytes.Compare(after, mstart) >= 0 {
+			mstart = append(bytes.Clone(after), 0x00)
+		}
+	}
+
+	return func(yield func(hit, error) bool) {
+		for k, err := range DB.KV.IterKeys(ctx, mstart, mend, opts...) {
+			if err != nil {
+				yield(hit{}, err)
+				return
+			}
+
+			// the id is the 8 byte timestamp at the very end of the key.
+			// it may itself contain 0xff, so don't split the key
+			if len(k) < 10 || k[len(k)-1] != 0xff || k[len(k)-10] != 0xff {
+				continue
+			}
+			id := k[len(k)-9 : len(k)-1]
+
+			if !yield(hit{id: id, pos: k, key: k}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// findAll returns the ids of every current document of model, found through their primary keys
+func (DB *DB) findAll(ctx context.Context, model string, after []byte) hits {
+	start := append([]byte{'k', 0xff}, model...)
 	start = append(start, 0xff)
-	end := bytes.Clone(start)
+	end := prefixEnd(start)
 
-	if op.err != nil {
-		return func(yield func([]byte, error) bool) {
-			yield(nil, op.err)
+	if after != nil && bytes.Compare(after, start) >= 0 {
+		start = append(bytes.Clone(after), 0x00)
+	}
+
+	return func(yield func(hit, error) bool) {
+		for kv, err := range DB.KV.Iter(ctx, start, end) {
+			if err != nil {
+				yield(hit{}, err)
+				return
+			}
+			if len(kv.V) != 8 && len(kv.V) != 16 {
+				continue
+			}
+			if !yield(hit{id: kv.V[:8], pos: kv.K, key: kv.K}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (DB *DB) findAnd(ctx context.Context, model string, ops []Filter, after []byte) (hits, bool) {
+	var sorted []Filter
+	var unsorted []Filter
+	var excluded []Filter
+
+	for _, op := range ops {
+		if op.err == nil && op.op == filterNot {
+			excluded = append(excluded, op.sub[0])
+		} else if DB.isSorted(op) {
+			sorted = append(sorted, op)
+		} else {
+			unsorted = append(unsorted, op)
 		}
 	}
-	start = append(start, op.start...)
-	end = append(end, op.end...)
 
-	return func(yield func([]byte, error) bool) {
-		for k, err := range DB.KV.IterKeys(ctx, start, end) {
+	// drive the scan with a sorted merge of all sorted inputs if there are any,
+	// and only load the remaining ones into memory.
+	// only the driver continues after a previous run, the others are needed in full.
+	var driver hits
+	isSorted := false
+	if len(sorted) > 0 {
+		var inputs []hits
+		for _, op := range sorted {
+			ids, _ := DB.findOp(ctx, model, op, after)
+			inputs = append(inputs, ids)
+		}
+		driver = intersectSorted(inputs)
+		isSorted = true
+	} else if len(unsorted) > 0 {
+		ids, _ := DB.findOp(ctx, model, unsorted[0], after)
+		driver = dedup(ids)
+		unsorted = unsorted[1:]
+	} else {
+		driver = DB.findAll(ctx, model, after)
+	}
+
+	return func(yield func(hit, error) bool) {
+		var required []map[string]struct{}
+		for _, op := range unsorted {
+			ids, _ := DB.findOp(ctx, model, op, nil)
+			set, err := collectIds(ids)
+			if err != nil {
+				yield(hit{}, err)
+				return
+			}
+			required = append(required, set)
+		}
+
+		var forbidden []map[string]struct{}
+		for _, op := range excluded {
+			ids, _ := DB.findOp(ctx, model, op, nil)
+			set, err := collectIds(ids)
 			if err != nil {
-				yield(nil, err)
+				yield(hit{}, err)
 				return
 			}
+			forbidden = append(forbidden, set)
+		}
 
-			kk := bytes.Split(k, []byte{0xff})
-			if len(kk) < 4 {
+	next:
+		for h, err := range driver {
+			if err != nil {
+				yield(hit{}, err)
+				return
+			}
+			for _, set := range required {
+				if _, ok := set[string(h.id)]; !ok {
+					continue next
+				}
+			}
+			for _, set := range forbidden {
+				if _, ok := set[string(h.id)]; ok {
+					continue next
+				}
+			}
+			if !yield(h, nil) {
+				return
+			}
+		}
+	}, isSorted
+}
+
+// findOr always yields sorted ids, either by merging sorted inputs
+// or by loading and sorting the ids of all inputs, so that it can continue by id.
+func (DB *DB) findOr(ctx context.Context, model string, ops []Filter, after []byte) (hits, bool) {
+	allSorted := true
+	for _, op := range ops {
+		allSorted = allSorted && DB.isSorted(op)
+	}
+
+	if allSorted {
+		var inputs []hits
+		for _, op := range ops {
+			ids, _ := DB.findOp(ctx, model, op, after)
+			inputs = append(inputs, ids)
+		}
+		return unionSorted(inputs), true
+	}
+
+	return func(yield func(hit, error) bool) {
+		keys := map[string][]byte{}
+		for _, op := range ops {
+			ids, _ := DB.findOp(ctx, model, op, nil)
+			for h, err := range ids {
+				if err != nil {
+					yield(hit{}, err)
+					return
+				}
+				keys[string(h.id)] = h.key
+			}
+		}
+
+		all := make([]string, 0, len(keys))
+		for id := range keys {
+			if after == nil || id > string(after) {
+				all = append(all, id)
+			}
+		}
+		sort.Strings(all)
+
+		for _, id := range all {
+			if !yield(hit{id: []byte(id), pos: []byte(id), key: keys[id]}, nil) {
+				return
+			}
+		}
+	}, true
+}
+
+// isSorted tells if findOp yields sorted ids for op, without running it
+func (DB *DB) isSorted(op Filter) bool {
+	if op.err != nil {
+		return false
+	}
+	switch op.op {
+	case filterOr:
+		return true
+	case filterAnd:
+		for _, sub := range op.sub {
+			if sub.err == nil && sub.op != filterNot && DB.isSorted(sub) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return false
+	}
+	return op.exact
+}
+
+func collectIds(ids hits) (map[string]struct{}, error) {
+	set := map[string]struct{}{}
+	for h, err := range ids {
+		if err != nil {
+			return nil, err
+		}
+		set[string(h.id)] = struct{}{}
+	}
+	return set, nil
+}
+
+// dedup drops ids that have already been seen,
+// for example because a document has multiple values in the scanned range
+func dedup(ids hits) hits {
+	return func(yield func(hit, error) bool) {
+		seen := map[string]struct{}{}
+		for h, err := range ids {
+			if err == nil {
+				if _, ok := seen[string(h.id)]; ok {
+					continue
+				}
+				seen[string(h.id)] = struct{}{}
+			}
+			if !yield(h, err) {
+				return
+			}
+		}
+	}
+}
+
+type sortedInput struct {
+	next func() (hit, error, bool)
+	stop func()
+	cur  []byte
+	key  []byte
+	done bool
+}
+
+func pullSorted(inputs []hits) []*sortedInput {
+	r := make([]*sortedInput, len(inputs))
+	for i, ids := range inputs {
+		next, stop := iter.Pull2(ids)
+		r[i] = &sortedInput{next: next, stop: stop}
+	}
+	return r
+}
+
+func (in *sortedInput) advance() error {
+	h, err, ok := in.next()
+	if !ok {
+		in.done = true
+		return nil
+	}
+	if err != nil {
+		in.done = true
+		return err
+	}
+	in.cur = h.id
+	in.key = h.key
+	return nil
+}
+
+// intersectSorted yields the ids present in all of the sorted inputs
+func intersectSorted(inputs []hits) hits {
+	return func(yield func(hit, error) bool) {
+		ins := pullSorted(inputs)
+		defer func() {
+			for _, in := range ins {
+				in.stop()
+			}
+		}()
+
+		for _, in := range ins {
+			if err := in.advance(); err != nil {
+				yield(hit{}, err)
+				return
+			}
+			if in.done {
+				return
+			}
+		}
+
+		for {
+			max := ins[0].cur
+			for _, in := range ins[1:] {
+				if bytes.Compare(in.cur, max) > 0 {
+					max = in.cur
+				}
+			}
+
+			equal := true
+			for _, in := range ins {
+				for bytes.Compare(in.cur, max) < 0 {
+					if err := in.advance(); err != nil {
+						yield(hit{}, err)
+						return
+					}
+					if in.done {
+						return
+					}
+				}
+				if !bytes.Equal(in.cur, max) {
+					equal = false
+				}
+			}
+			if !equal {
 				continue
 			}
-			id := kk[len(kk)-2]
 
-			if !yield(id, nil) {
+			if !yield(hit{id: max, pos: max, key: ins[0].key}, nil) {
+				return
+			}
+			for _, in := range ins {
+				if err := in.advance(); err != nil {
+					yield(hit{}, err)
+					return
+				}
+				if in.done {
+					return
+				}
+			}
+		}
+	}
+}
+
+// unionSorted yields the ids present in any of the sorted inputs, in sorted order and without duplicates
+func unionSorted(inputs []hits) hits {
+	return func(yield func(hit, error) bool) {
+		ins := pullSorted(inputs)
+		defer func() {
+			for _, in := range ins {
+				in.stop()
+			}
+		}()
+
+		for _, in := range ins {
+			if err := in.advance(); err != nil {
+				yield(hit{}, err)
 				return
 			}
 		}
+
+		for {
+			var min, key []byte
+			for _, in := range ins {
+				if !in.done && (min == nil || bytes.Compare(in.cur, min) < 0) {
+					min = in.cur
+					key = in.key
+				}
+			}
+			if min == nil {
+				return
+			}
+
+			if !yield(hit{id: min, pos: min, key: key}, nil) {
+				return
+			}
+
+			for _, in := range ins {
+				for !in.done && bytes.Compare(in.cur, min) <= 0 {
+					if err := in.advance(); err != nil {
+						yield(hit{}, err)
+						return
+					}
+				}
+			}
+		}
 	}
 }
@@ -0,0 +1,339 @@
+package kane
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+type FindTestDoc struct {
+	ID    string
+	Name  string
+	Age   int
+	Score float64
+	Tags  []any
+}
+
+func (d *FindTestDoc) PK() any {
+	return d.ID
+}
+
+func TestFindOperations(t *testing.T) {
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		docs := []*FindTestDoc{
+			{ID: "find-test-1", Name: "Alice", Age: 17, Score: -1.5, Tags: []any{"a", "b"}},
+			{ID: "find-test-2", Name: "Bob", Age: 18, Score: -0.5, Tags: []any{"b"}},
+			{ID: "find-test-3", Name: "Charlie", Age: 25, Score: 0},
+			{ID: "find-test-4", Name: "Dave", Age: 30, Score: 1.2},
+			{ID: "find-test-5", Name: "Eve", Age: 31, Score: 1.9},
+		}
+
+		for _, doc := range docs {
+			err := db.Put(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to put document %s: %v", doc.ID, err)
+			}
+		}
+
+		ids := func(t *testing.T, op Filter) []string {
+			var r []string
+			for doc, err := range Iter[FindTestDoc](ctx, db, op) {
+				if err != nil {
+					t.Fatalf("Iteration error: %v", err)
+				}
+				r = append(r, doc.ID)
+			}
+			sort.Strings(r)
+			return r
+		}
+
+		ordered := func(t *testing.T, op Filter, opts ...Opt) []string {
+			var r []string
+			for doc, err := range Iter[FindTestDoc](ctx, db, op, opts...) {
+				if err != nil {
+					t.Fatalf("Iteration error: %v", err)
+				}
+				r = append(r, doc.ID)
+			}
+			return r
+		}
+
+		expect := func(t *testing.T, got []string, want ...string) {
+			if len(got) != len(want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+			}
+		}
+
+		t.Run("Gt", func(t *testing.T) {
+			expect(t, ids(t, Gt("Age", 25)), "find-test-4", "find-test-5")
+		})
+
+		t.Run("Gte", func(t *testing.T) {
+			expect(t, ids(t, Gte("Age", 25)), "find-test-3", "find-test-4", "find-test-5")
+		})
+
+		t.Run("Lt", func(t *testing.T) {
+			expect(t, ids(t, Lt("Age", 18)), "find-test-1")
+		})
+
+		t.Run("Lte", func(t *testing.T) {
+			expect(t, ids(t, Lte("Age", 18)), "find-test-1", "find-test-2")
+		})
+
+		t.Run("Between", func(t *testing.T) {
+			expect(t, ids(t, Between("Age", 18, 30)), "find-test-2", "find-test-3", "find-test-4")
+		})
+
+		t.Run("RangeDoesNotCrossTypes", func(t *testing.T) {
+			expect(t, ids(t, Gt("Age", 0)), "find-test-1", "find-test-2", "find-test-3", "find-test-4", "find-test-5")
+			expect(t, ids(t, Gt("Name", "")), "find-test-1", "find-test-2", "find-test-3", "find-test-4", "find-test-5")
+		})
+
+		t.Run("Floats", func(t *testing.T) {
+			expect(t, ids(t, Eq("Score", 1.2)), "find-test-4")
+			expect(t, ids(t, Gt("Score", 1.2)), "find-test-5")
+			expect(t, ids(t, Lt("Score", 0)), "find-test-1", "find-test-2")
+			expect(t, ids(t, Between("Score", -1, 1)), "find-test-2", "find-test-3")
+		})
+
+		t.Run("NumbersOfDifferentTypes", func(t *testing.T) {
+			expect(t, ids(t, Eq("Score", 0)), "find-test-3")
+			expect(t, ids(t, Eq("Age", 25.0)), "find-test-3")
+			expect(t, ids(t, Lt("Score", int8(-1))), "find-test-1")
+			expect(t, ids(t, Gte("Age", uint64(31))), "find-test-5")
+		})
+
+		t.Run("StringPrefixOrder", func(t *testing.T) {
+			expect(t, ids(t, Gt("Name", "Bo")), "find-test-2", "find-test-3", "find-test-4", "find-test-5")
+			expect(t, ids(t, Lte("Name", "Bo")), "find-test-1")
+		})
+
+		t.Run("And", func(t *testing.T) {
+			expect(t, ids(t, And(Eq("Name", "Bob"), Eq("Age", 18))), "find-test-2")
+			expect(t, ids(t, And(Eq("Name", "Bob"), Eq("Age", 25))))
+			expect(t, ids(t, And(Gte("Age", 18), Lt("Score", 1))), "find-test-2", "find-test-3")
+			expect(t, ids(t, And(Eq("Age", 25), Has("Score"), Gt("Name", "A"))), "find-test-3")
+		})
+
+		t.Run("Or", func(t *testing.T) {
+			expect(t, ids(t, Or(Eq("Name", "Alice"), Eq("Name", "Eve"), Eq("Age", 17))), "find-test-1", "find-test-5")
+			expect(t, ids(t, Or(Lt("Age", 18), Gt("Age", 30), Eq("Name", "Eve"))), "find-test-1", "find-test-5")
+		})
+
+		t.Run("Not", func(t *testing.T) {
+			expect(t, ids(t, Not(Eq("Name", "Bob"))), "find-test-1", "find-test-3", "find-test-4", "find-test-5")
+			expect(t, ids(t, And(Gte("Age", 18), Not(Eq("Name", "Bob")), Not(Gt("Score", 1.5)))), "find-test-3", "find-test-4")
+			expect(t, ids(t, Or(Eq("Name", "Bob"), Not(Has("Name")))), "find-test-2")
+		})
+
+		t.Run("Prefix", func(t *testing.T) {
+			expect(t, ids(t, Prefix("Name", "Ch")), "find-test-3")
+			expect(t, ids(t, Prefix("Name", "Charlie")), "find-test-3")
+			expect(t, ids(t, Prefix("Name", "Charlies")))
+			expect(t, ids(t, Prefix("Name", "")), "find-test-1", "find-test-2", "find-test-3", "find-test-4", "find-test-5")
+			expect(t, ids(t, Prefix("Age", "1")))
+		})
+
+		t.Run("In", func(t *testing.T) {
+			expect(t, ids(t, In("Name", "Alice", "Eve", "Nobody")), "find-test-1", "find-test-5")
+			expect(t, ids(t, In("Age", 17, 17.0, 31)), "find-test-1", "find-test-5")
+			expect(t, ids(t, In("Age")))
+			expect(t, ids(t, And(In("Age", 17, 18, 25), Prefix("Name", "B"))), "find-test-2")
+		})
+
+		t.Run("OrderBy", func(t *testing.T) {
+			expect(t, ordered(t, Has("Age"), OrderBy("Age", Asc)), "find-test-1", "find-test-2", "find-test-3", "find-test-4", "find-test-5")
+			expect(t, ordered(t, Has("Age"), OrderBy("Age", Desc)), "find-test-5", "find-test-4", "find-test-3", "find-test-2", "find-test-1")
+			expect(t, ordered(t, Gte("Age", 18), OrderBy("Age", Desc)), "find-test-5", "find-test-4", "find-test-3", "find-test-2")
+			expect(t, ordered(t, Lt("Score", 1), OrderBy("Name", Desc)), "find-test-3", "find-test-2", "find-test-1")
+			expect(t, ordered(t, Or(Eq("Age", 31), Eq("Age", 17)), OrderBy("Score", Asc)), "find-test-1", "find-test-5")
+			expect(t, ordered(t, Has("Age"), OrderBy("Missing", Asc)))
+
+			var doc FindTestDoc
+			err := db.Get(ctx, &doc, Has("Age"), OrderBy("Score", Desc))
+			if err != nil {
+				t.Fatalf("Failed to get document: %v", err)
+			}
+			if doc.ID != "find-test-5" {
+				t.Errorf("Expected find-test-5, got %s", doc.ID)
+			}
+		})
+
+		t.Run("Cursor", func(t *testing.T) {
+			pages := func(t *testing.T, op Filter, opts ...Opt) []string {
+				var r []string
+				var c string
+				for i := 0; i < 10; i++ {
+					page := ordered(t, op, append(opts, Limit(2), Cursor(&c))...)
+					if len(page) > 2 {
+						t.Fatalf("page %d has %d documents, limit is 2", i, len(page))
+					}
+					r = append(r, page...)
+					if c == "" {
+						return r
+					}
+				}
+				t.Fatalf("cursor did not end")
+				return nil
+			}
+
+			expect(t, pages(t, Has("Age"), OrderBy("Age", Desc)), "find-test-5", "find-test-4", "find-test-3", "find-test-2", "find-test-1")
+			expect(t, pages(t, Gte("Age", 18), OrderBy("Name", Asc)), "find-test-2", "find-test-3", "find-test-4", "find-test-5")
+
+			for _, op := range []Filter{
+				Has("Age"),
+				Between("Score", -1, 1.5),
+				Or(Eq("Age", 31), Eq("Age", 17), Eq("Age", 25)),
+				Or(Lt("Age", 18), Gt("Age", 25)),
+				And(Has("Name"), Not(Eq("Age", 25))),
+				Not(Eq("Age", 18)),
+			} {
+				got := pages(t, op)
+				sort.Strings(got)
+				expect(t, got, ids(t, op)...)
+			}
+
+			// documents inserted before the cursor are not returned, and nothing is returned twice
+			var c string
+			first := ordered(t, Has("Age"), OrderBy("Age", Asc), Limit(2), Cursor(&c))
+			expect(t, first, "find-test-1", "find-test-2")
+			late := &FindTestDoc{ID: "find-test-6", Name: "Frank", Age: 1}
+			if err := db.Put(ctx, late); err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			defer db.Del(ctx, late)
+			expect(t, ordered(t, Has("Age"), OrderBy("Age", Asc), Cursor(&c)), "find-test-3", "find-test-4", "find-test-5")
+			if c != "" {
+				t.Errorf("Expected cursor to be empty at the end, got %q", c)
+			}
+
+			c = "not a cursor!"
+			for _, err := range Iter[FindTestDoc](ctx, db, Has("Age"), Cursor(&c)) {
+				if err == nil {
+					t.Error("Expected error for invalid cursor")
+				}
+				break
+			}
+		})
+
+		t.Run("Array", func(t *testing.T) {
+			// find-test-1 has two tags in every range, but is only returned once
+			expect(t, ids(t, Has("Tags")), "find-test-1", "find-test-2")
+			expect(t, ids(t, Gte("Tags", "a")), "find-test-1", "find-test-2")
+			expect(t, ids(t, Prefix("Tags", "")), "find-test-1", "find-test-2")
+		})
+
+		t.Run("Count", func(t *testing.T) {
+			for _, tc := range []struct {
+				op   Filter
+				want int
+			}{
+				{Has("Age"), 5},
+				{Gt("Age", 18), 3},
+				{Has("Tags"), 2},
+				{Between("Tags", "a", "b"), 2},
+				{Or(Eq("Tags", "a"), Eq("Tags", "b")), 2},
+				{And(Has("Tags"), Not(Eq("Tags", "a"))), 1},
+				{Eq("Age", 99), 0},
+			} {
+				n, err := db.Count(ctx, FindTestDoc{}, tc.op)
+				if err != nil {
+					t.Fatalf("Failed to count: %v", err)
+				}
+				if n != tc.want {
+					t.Errorf("Expected count %d, got %d", tc.want, n)
+				}
+			}
+
+			ok, err := db.Exists(ctx, FindTestDoc{}, Eq("Tags", "b"))
+			if err != nil {
+				t.Fatalf("Failed to check existence: %v", err)
+			}
+			if !ok {
+				t.Error("Expected document to exist")
+			}
+
+			ok, err = db.Exists(ctx, FindTestDoc{}, Eq("Tags", "c"))
+			if err != nil {
+				t.Fatalf("Failed to check existence: %v", err)
+			}
+			if ok {
+				t.Error("Expected document not to exist")
+			}
+		})
+
+		t.Run("GetWithRange", func(t *testing.T) {
+			var doc FindTestDoc
+			err := db.Get(ctx, &doc, Gt("Age", 30))
+			if err != nil {
+				t.Fatalf("Failed to get document: %v", err)
+			}
+			if doc.ID != "find-test-5" {
+				t.Errorf("Expected find-test-5, got %s", doc.ID)
+			}
+		})
+
+		t.Run("InvalidRange", func(t *testing.T) {
+			for _, err := range Iter[FindTestDoc](ctx, db, Between("Age", 1, "z")) {
+				if err == nil {
+					t.Error("Expected error for mismatched range bounds")
+				}
+				break
+			}
+		})
+
+		t.Run("InvalidKey", func(t *testing.T) {
+			_, err := db.Count(ctx, FindTestDoc{}, Eq("Na\xffme", "Bob"))
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Expected ErrInvalidKey, got %v", err)
+			}
+		})
+
+		for _, doc := range docs {
+			err := db.Del(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to delete document %s: %v", doc.ID, err)
+			}
+		}
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-find-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
@@ -0,0 +1,50 @@
+package kane
+
+import (
+	"bytes"
+)
+
+// FuncIndex indexes values derived from a document, like a lower-cased email, see IndexFunc
+type FuncIndex struct {
+	name   string
+	values func(val any) []any
+}
+
+// IndexFunc returns an index of the values fn returns for each document of type T, see ModelSchema.
+// they are indexed like the values of a field called name, and can be queried by it with any filter.
+// fn must only depend on the document, since the index is only updated when the document is written.
+func IndexFunc[T any](name string, fn func(*T) []any) FuncIndex {
+	return FuncIndex{
+		name: name,
+		values: func(val any) []any {
+			switch v := val.(type) {
+			case *T:
+				if v == nil {
+					return nil
+				}
+				return fn(v)
+			case T:
+				return fn(&v)
+			}
+			// stored with another type, like generic JSON
+			return nil
+		},
+	}
+}
+
+// funcKeys collects the index keys of the values funcs derive from doc
+func (DB *DB) funcKeys(doc *StoredDocument, funcs []FuncIndex, path []byte, postfix []byte, keys *[][]byte) error {
+	for _, f := range funcs {
+		if f.name == "" || bytes.IndexByte([]byte(f.name), 0xff) >= 0 {
+			continue
+		}
+		fpath := append(bytes.Clone(path), f.name...)
+		for _, v := range f.values(doc.Val) {
+			err := DB.indexI(v, fpath, postfix, true, keys)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
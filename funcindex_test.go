@@ -0,0 +1,185 @@
+package kane
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type FuncIndexTestDoc struct {
+	ID    string
+	Email string `kane:"noindex"`
+	Born  time.Time
+	Tags  []string `kane:"noindex"`
+}
+
+func (d FuncIndexTestDoc) PK() any {
+	return d.ID
+}
+
+func (d *FuncIndexTestDoc) Schema() ModelSchema {
+	return ModelSchema{
+		Funcs: []FuncIndex{
+			IndexFunc("email_lower", func(d *FuncIndexTestDoc) []any {
+				return []any{strings.ToLower(d.Email)}
+			}),
+			IndexFunc("born_year", func(d *FuncIndexTestDoc) []any {
+				return []any{d.Born.Year()}
+			}),
+			IndexFunc("tag", func(d *FuncIndexTestDoc) []any {
+				var tags []any
+				for _, tag := range d.Tags {
+					tags = append(tags, strings.TrimPrefix(tag, "#"))
+				}
+				return tags
+			}),
+		},
+	}
+}
+
+func TestFuncIndex(t *testing.T) {
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		docs := []*FuncIndexTestDoc{
+			{ID: "func-test-a", Email: "Alice@Example.com", Born: time.Date(1985, 3, 1, 0, 0, 0, 0, time.UTC), Tags: []string{"#go", "db"}},
+			{ID: "func-test-b", Email: "bob@example.com", Born: time.Date(1992, 7, 1, 0, 0, 0, 0, time.UTC), Tags: []string{"#db"}},
+			{ID: "func-test-c", Email: "CAROL@example.com", Born: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)},
+		}
+		for _, doc := range docs {
+			if err := db.Put(ctx, doc); err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+		}
+
+		ids := func(t *testing.T, op Filter, opts ...Opt) []string {
+			var ids []string
+			for doc, err := range Iter[FuncIndexTestDoc](ctx, db, op, opts...) {
+				if err != nil {
+					t.Fatalf("Failed to iterate: %v", err)
+				}
+				ids = append(ids, doc.ID)
+			}
+			return ids
+		}
+
+		t.Run("Build", func(t *testing.T) {
+			// as if the documents were written before the index was declared
+			prefix := []byte("f\xffFuncIndexTestDoc\xff.email_lower\xff")
+			var keys [][]byte
+			for k, err := range db.KV.IterKeys(ctx, prefix, prefixEnd(prefix)) {
+				if err != nil {
+					t.Fatalf("Failed to iterate keys: %v", err)
+				}
+				keys = append(keys, k)
+			}
+			db.delKeys(ctx, keys)
+			db.KV.Del(ctx, builtPath("FuncIndexTestDoc", "email_lower"))
+			db.built.Delete("FuncIndexTestDoc\xffemail_lower")
+
+			if _, err := db.Count(ctx, FuncIndexTestDoc{}, Eq("email_lower", "alice@example.com")); !errors.Is(err, ErrNotIndexed) {
+				t.Errorf("Expected ErrNotIndexed before the build, got %v", err)
+			}
+			if err := db.BuildIndexes(ctx, FuncIndexTestDoc{}); err != nil {
+				t.Fatalf("Failed to build indexes: %v", err)
+			}
+		})
+
+		t.Run("Eq", func(t *testing.T) {
+			var got FuncIndexTestDoc
+			if err := db.Get(ctx, &got, Eq("email_lower", "alice@example.com")); err != nil || got.ID != "func-test-a" {
+				t.Errorf("Expected alice by lower-cased email, got %v %v", got, err)
+			}
+
+			// the field itself is not indexed
+			if err := db.Get(ctx, &got, Eq("Email", "Alice@Example.com")); err == nil {
+				t.Errorf("Expected Email not to be queryable")
+			}
+
+			found := ids(t, Eq("tag", "db"))
+			slices.Sort(found)
+			if !slices.Equal(found, []string{"func-test-a", "func-test-b"}) {
+				t.Errorf("Expected every value to be indexed, got %v", found)
+			}
+		})
+
+		t.Run("Range", func(t *testing.T) {
+			got := ids(t, Gte("born_year", 1990), OrderBy("born_year", Desc))
+			if !slices.Equal(got, []string{"func-test-c", "func-test-b"}) {
+				t.Errorf("Expected documents born since 1990 by year, got %v", got)
+			}
+		})
+
+		t.Run("Update", func(t *testing.T) {
+			docs[1].Email = "Robert@Example.com"
+			if err := db.Set(ctx, docs[1]); err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+			if got := ids(t, Eq("email_lower", "bob@example.com")); len(got) != 0 {
+				t.Errorf("Expected old derived value to be gone, got %v", got)
+			}
+			if got := ids(t, Eq("email_lower", "robert@example.com")); !slices.Equal(got, []string{"func-test-b"}) {
+				t.Errorf("Expected new derived value, got %v", got)
+			}
+		})
+
+		t.Run("Verify", func(t *testing.T) {
+			reports, err := db.Verify(ctx, Models(FuncIndexTestDoc{}))
+			if err != nil {
+				t.Fatalf("Failed to verify: %v", err)
+			}
+			r := reports["FuncIndexTestDoc"]
+			if r == nil || len(r.Missing)+len(r.Extra)+len(r.MisEncoded) != 0 {
+				t.Errorf("Expected a clean index, got %+v", r)
+			}
+		})
+
+		t.Run("DelByValue", func(t *testing.T) {
+			if err := db.Del(ctx, FuncIndexTestDoc{ID: docs[2].ID}); err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+			if got := ids(t, Eq("email_lower", "carol@example.com")); len(got) != 0 {
+				t.Errorf("Expected the derived keys of the deleted document to be gone, got %v", got)
+			}
+		})
+
+		for _, doc := range docs {
+			db.Del(ctx, doc)
+		}
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-funcindex-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
@@ -0,0 +1,239 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/aep/kane/kv"
+)
+
+// DefaultGCHorizon is how old garbage has to be for GC to collect it, unless the Horizon option is set
+const DefaultGCHorizon = time.Hour
+
+// GCReport lists the keys GC found, and deleted unless it was a dry run
+type GCReport struct {
+	// Pointers are primary key pointers to objects that do not exist
+	Pointers [][]byte
+	// Objects are objects that no primary key points to
+	Objects [][]byte
+	// IndexKeys are index keys of objects that no primary key points to
+	IndexKeys [][]byte
+	// StaleKeys are index keys of existing documents that they no longer have.
+	// they are only looked for in the models passed with the Models option
+	StaleKeys [][]byte
+}
+
+// GC deletes what crashed writes left behind: primary key pointers to objects that do not exist,
+// objects that no primary key points to, and the index keys of those objects.
+// it can run while the database is in use, since only garbage older than the Horizon option is collected,
+// which is never less than the time a write may hold a lock.
+// index keys of existing documents that a failed write did not remove can only be told apart
+// from the keys the documents still have by deriving them from the Go type,
+// so they are only collected for the models passed with the Models option, like Verify, regardless of the Horizon.
+// with the DryRun option it only reports what it would delete.
+// the ids of all objects are held in memory while it runs.
+func (DB *DB) GC(ctx context.Context, opts ...Opt) (*GCReport, error) {
+	q := parseOpts(opts)
+	horizon := DefaultGCHorizon
+	if q.horizon != nil {
+		horizon = max(*q.horizon, DB.writeLockTimeout())
+	}
+
+	vt, err := DB.KV.GetVectorTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := kv.VectorTimeToTime(vt).Add(-horizon)
+	old := func(oid []byte) bool {
+		return kv.VectorTimeToTime(binary.LittleEndian.Uint64(oid)).Before(cutoff)
+	}
+
+	report := &GCReport{}
+	live := map[[8]byte]struct{}{}
+
+	// pointers of the models to look for stale keys in
+	typed := map[string][]kv.KeyAndValue{}
+
+	// pointers first, so that objects are only collected if nothing points to them anymore
+	var batch []kv.KeyAndValue
+	var dangling []kv.KeyAndValue
+	checkPointers := func() error {
+		paths := make([][]byte, len(batch))
+		for i, p := range batch {
+			paths[i] = objectPath(p.V[:8])
+		}
+		objects, err := DB.KV.BatchGet(ctx, paths)
+		if err != nil {
+			return err
+		}
+
+		for i, p := range batch {
+			// a pointer locked by a write that is not over yet may not have its object yet
+			if objects[i] == nil && (len(p.V) == 8 || old(p.V[8:])) {
+				dangling = append(dangling, p)
+			} else {
+				live[[8]byte(p.V[:8])] = struct{}{}
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	start := []byte{'k', 0xff}
+	for p, err := range DB.KV.Iter(ctx, start, prefixEnd(start)) {
+		if err != nil {
+			return nil, err
+		}
+		if len(p.V) != 8 && len(p.V) != 16 {
+			continue
+		}
+		if end := bytes.IndexByte(p.K[2:], 0xff); end >= 0 {
+			if _, ok := q.models[string(p.K[2:2+end])]; ok {
+				typed[string(p.K[2:2+end])] = append(typed[string(p.K[2:2+end])], p)
+			}
+		}
+		batch = append(batch, p)
+		if len(batch) >= 1000 {
+			err = checkPointers()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = checkPointers()
+	if err != nil {
+		return nil, err
+	}
+
+	// not deleted while iterating, like MigrateIndex
+	for _, p := range dangling {
+		ok := true
+		if !q.dryRun {
+			ok, err = DB.gcPointer(ctx, p.K)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ok {
+			report.Pointers = append(report.Pointers, p.K)
+		} else {
+			live[[8]byte(p.V[:8])] = struct{}{}
+		}
+	}
+
+	start = []byte{'o', 0xff}
+	for k, err := range DB.KV.IterKeys(ctx, start, prefixEnd(start)) {
+		if err != nil {
+			return nil, err
+		}
+		if len(k) != 11 {
+			continue
+		}
+		oid := k[2:10]
+		if _, ok := live[[8]byte(oid)]; !ok && old(oid) {
+			report.Objects = append(report.Objects, k)
+		}
+	}
+
+	start = []byte{'f', 0xff}
+	for k, err := range DB.KV.IterKeys(ctx, start, prefixEnd(start)) {
+		if err != nil {
+			return nil, err
+		}
+		if len(k) < 12 {
+			continue
+		}
+		oid := k[len(k)-9 : len(k)-1]
+		if _, ok := live[[8]byte(oid)]; !ok && old(oid) {
+			report.IndexKeys = append(report.IndexKeys, k)
+		}
+	}
+
+	stale := map[string]map[[8]byte][][]byte{}
+	for model, ptrs := range typed {
+		r, err := DB.verifyModel(ctx, model, q.models[model], ptrs, cutoff, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range r.Extra {
+			oid := [8]byte(k[len(k)-9 : len(k)-1])
+			if _, ok := live[oid]; !ok {
+				// collected above
+				continue
+			}
+			if stale[model] == nil {
+				stale[model] = map[[8]byte][][]byte{}
+			}
+			stale[model][oid] = append(stale[model][oid], k)
+			report.StaleKeys = append(report.StaleKeys, k)
+		}
+	}
+
+	if q.dryRun {
+		return report, nil
+	}
+
+	// index keys before objects, like Del, so that an interrupted GC leaves nothing that points nowhere
+	for _, k := range report.IndexKeys {
+		err = DB.KV.Del(ctx, k)
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, k := range report.Objects {
+		err = DB.KV.Del(ctx, k)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// under the lock of the document, like Verify repairs, so that keys a write just added are not taken for stale
+	ptrs := map[[8]byte][]byte{}
+	for _, mptrs := range typed {
+		for _, p := range mptrs {
+			ptrs[[8]byte(p.V[:8])] = p.K
+		}
+	}
+	for model, byDoc := range stale {
+		for oid, keys := range byDoc {
+			err = DB.repairDocument(ctx, model, q.models[model], ptrs[oid], oid[:], keys)
+			if err != nil && !errors.Is(err, errLocked) {
+				return report, err
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// gcPointer deletes the primary key pointer at pkpath if its object still does not exist
+func (DB *DB) gcPointer(ctx context.Context, pkpath []byte) (bool, error) {
+	vt, err := DB.KV.GetVectorTime(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	_, locked, err := DB.lock(ctx, pkpath, vt, false)
+	if errors.Is(err, ErrNotFound) {
+		return true, nil
+	}
+	if errors.Is(err, errLocked) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	oid := locked[:8]
+	_, err = DB.KV.Get(ctx, objectPath(oid))
+	if err == nil || !errors.Is(err, kv.ErrNotFound) {
+		// written in the meantime
+		DB.unlock(ctx, pkpath, locked, oid)
+		return false, err
+	}
+
+	return true, DB.unlock(ctx, pkpath, locked, nil)
+}
@@ -0,0 +1,249 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aep/kane/kv"
+)
+
+type GCTestDoc struct {
+	ID   string
+	Name string
+}
+
+func (d *GCTestDoc) PK() any {
+	return d.ID
+}
+
+func TestGC(t *testing.T) {
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		pkpath := func(doc *GCTestDoc) []byte {
+			pk, _ := getPKFromAny(doc)
+			path := append([]byte("k\xffGCTestDoc\xff"), pk...)
+			return append(path, 0xff)
+		}
+
+		keysOf := func(t *testing.T, doc *GCTestDoc, oid []byte) [][]byte {
+			keys, err := db.indexKeys(&StoredDocument{Val: doc}, []byte("GCTestDoc"), oid)
+			if err != nil {
+				t.Fatalf("Failed to get index keys: %v", err)
+			}
+			return keys
+		}
+
+		// move a document to an object id from long ago, as if a write crashed back then
+		age := func(t *testing.T, doc *GCTestDoc, oid []byte) {
+			cur, err := db.KV.Get(ctx, pkpath(doc))
+			if err != nil {
+				t.Fatalf("Failed to read pointer: %v", err)
+			}
+			b, err := db.KV.Get(ctx, objectPath(cur))
+			if err != nil {
+				t.Fatalf("Failed to read object: %v", err)
+			}
+			for _, k := range keysOf(t, doc, cur) {
+				db.KV.Del(ctx, k)
+			}
+			for _, k := range keysOf(t, doc, oid) {
+				db.KV.Set(ctx, k, []byte{0xff})
+			}
+			db.KV.Del(ctx, objectPath(cur))
+			db.KV.Set(ctx, objectPath(oid), b)
+			db.KV.Set(ctx, pkpath(doc), oid)
+		}
+
+		exists := func(t *testing.T, key []byte) bool {
+			_, err := db.KV.Get(ctx, key)
+			if err != nil && !errors.Is(err, kv.ErrNotFound) {
+				t.Fatalf("Failed to read key: %v", err)
+			}
+			return err == nil
+		}
+
+		live := &GCTestDoc{ID: "gc-test-live", Name: "Live"}
+		pointer := &GCTestDoc{ID: "gc-test-pointer", Name: "Pointer"}
+		orphan := &GCTestDoc{ID: "gc-test-orphan", Name: "Orphan"}
+		recent := &GCTestDoc{ID: "gc-test-recent", Name: "Recent"}
+		for _, doc := range []*GCTestDoc{live, pointer, orphan, recent} {
+			if err := db.Put(ctx, doc); err != nil {
+				t.Fatalf("Failed to put document %s: %v", doc.ID, err)
+			}
+		}
+
+		base := uint64(time.Now().Add(-2*time.Hour).UnixMilli()) << 18
+		pointerOid := binary.LittleEndian.AppendUint64(nil, base)
+		orphanOid := binary.LittleEndian.AppendUint64(nil, base+1)
+
+		// a pointer to an object that is gone, and an object nothing points to
+		age(t, pointer, pointerOid)
+		db.KV.Del(ctx, objectPath(pointerOid))
+		age(t, orphan, orphanOid)
+		db.KV.Del(ctx, pkpath(orphan))
+
+		// recent garbage may still be a write in progress
+		recentOid, err := db.KV.Get(ctx, pkpath(recent))
+		if err != nil {
+			t.Fatalf("Failed to read pointer: %v", err)
+		}
+		db.KV.Del(ctx, pkpath(recent))
+
+		garbage := append(keysOf(t, pointer, pointerOid), keysOf(t, orphan, orphanOid)...)
+		garbage = append(garbage, pkpath(pointer), objectPath(orphanOid))
+		liveOid, err := db.KV.Get(ctx, pkpath(live))
+		if err != nil {
+			t.Fatalf("Failed to read pointer: %v", err)
+		}
+		kept := append(keysOf(t, live, liveOid), keysOf(t, recent, recentOid)...)
+		kept = append(kept, pkpath(live), objectPath(liveOid), objectPath(recentOid))
+
+		found := func(r *GCReport) [][]byte {
+			return slices.Concat(r.Pointers, r.Objects, r.IndexKeys)
+		}
+		check := func(t *testing.T, r *GCReport) {
+			all := found(r)
+			for _, k := range garbage {
+				if !slices.ContainsFunc(all, func(f []byte) bool { return bytes.Equal(f, k) }) {
+					t.Errorf("Expected %q to be garbage", k)
+				}
+			}
+			for _, k := range kept {
+				if slices.ContainsFunc(all, func(f []byte) bool { return bytes.Equal(f, k) }) {
+					t.Errorf("Expected %q not to be garbage", k)
+				}
+			}
+		}
+
+		t.Run("DryRun", func(t *testing.T) {
+			r, err := db.GC(ctx, DryRun())
+			if err != nil {
+				t.Fatalf("Failed to collect garbage: %v", err)
+			}
+			check(t, r)
+			for _, k := range garbage {
+				if !exists(t, k) {
+					t.Errorf("Expected dry run not to delete %q", k)
+				}
+			}
+		})
+
+		t.Run("Collect", func(t *testing.T) {
+			r, err := db.GC(ctx, Horizon(time.Minute))
+			if err != nil {
+				t.Fatalf("Failed to collect garbage: %v", err)
+			}
+			check(t, r)
+			for _, k := range garbage {
+				if exists(t, k) {
+					t.Errorf("Expected %q to be deleted", k)
+				}
+			}
+			for _, k := range kept {
+				if !exists(t, k) {
+					t.Errorf("Expected %q to be kept", k)
+				}
+			}
+
+			got, err := GetPK[GCTestDoc](ctx, db, live.ID)
+			if err != nil || got.Name != "Live" {
+				t.Errorf("Expected live document to be kept, got %v %v", got, err)
+			}
+			n, err := db.Count(ctx, GCTestDoc{}, Has("ID"))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if n != 2 {
+				t.Errorf("Expected 2 indexed documents, got %d", n)
+			}
+
+			// the pointer is gone, so the document can be created again
+			if err := db.Put(ctx, pointer); err != nil {
+				t.Errorf("Failed to put document again: %v", err)
+			}
+			db.Del(ctx, pointer)
+		})
+
+		t.Run("Stale", func(t *testing.T) {
+			// a write that failed to remove the key of a value the document no longer has
+			stale := keysOf(t, &GCTestDoc{ID: live.ID, Name: "Old"}, liveOid)
+			for _, k := range stale {
+				db.KV.Set(ctx, k, []byte{0xff})
+			}
+			count := func(t *testing.T, name string) int {
+				n, err := db.Count(ctx, GCTestDoc{}, Eq("Name", name))
+				if err != nil {
+					t.Fatalf("Failed to count: %v", err)
+				}
+				return n
+			}
+
+			// without the type, the keys a document should have are not known
+			r, err := db.GC(ctx, Horizon(time.Minute))
+			if err != nil {
+				t.Fatalf("Failed to collect garbage: %v", err)
+			}
+			if len(r.StaleKeys) != 0 || count(t, "Old") != 1 {
+				t.Errorf("Expected no stale keys without Models, got %q", r.StaleKeys)
+			}
+
+			r, err = db.GC(ctx, Horizon(time.Minute), Models(GCTestDoc{}))
+			if err != nil {
+				t.Fatalf("Failed to collect garbage: %v", err)
+			}
+			if len(r.StaleKeys) != 1 {
+				t.Errorf("Expected the stale key of the old value, got %q", r.StaleKeys)
+			}
+			if n := count(t, "Old"); n != 0 {
+				t.Errorf("Expected stale key to be collected, got %d", n)
+			}
+			if n := count(t, "Live"); n != 1 {
+				t.Errorf("Expected current key to be kept, got %d", n)
+			}
+		})
+
+		db.Del(ctx, live)
+		for _, k := range keysOf(t, recent, recentOid) {
+			db.KV.Del(ctx, k)
+		}
+		db.KV.Del(ctx, objectPath(recentOid))
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-gc-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
@@ -2,24 +2,36 @@ package kane
 
 import (
 	"bytes"
-	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
-	"strings"
+	"strconv"
 )
 
+// the current format of index keys, see MigrateIndex
+const IndexVersion = 2
+
 const (
 	ValueInvalid = iota
+
+	// IndexVersion 1
 	ValueInteger
 	ValueString
 	ValueFloat
 	ValueBytes
+
 	ValueBool
+
+	// IndexVersion 2
+	ValueNumber
+	ValueText
+	ValueBinary
 )
 
-func (DB *DB) index(ctx context.Context, doc *StoredDocument, model []byte, id []byte, creating bool) error {
+// indexKeys returns the index keys of doc stored as object id
+func (DB *DB) indexKeys(doc *StoredDocument, model []byte, id []byte) ([][]byte, error) {
 	path := append([]byte{'f', 0xff}, model...)
 	path = append(path, 0xff)
 	path = append(path, '.')
@@ -27,10 +39,30 @@ func (DB *DB) index(ctx context.Context, doc *StoredDocument, model []byte, id [
 	postfix := append([]byte{0xff}, id[:]...)
 	postfix = append(postfix, 0xff)
 
-	return DB.indexI(ctx, doc.Val, path, postfix, creating)
+	schema, err := schemaOf(docType(doc))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	err = DB.indexI(doc.Val, path, postfix, !schema.NoIndex, &keys)
+	if err != nil {
+		return keys, err
+	}
+	err = DB.funcKeys(doc, schema.Funcs, path, postfix, &keys)
+	if err != nil {
+		return keys, err
+	}
+	for _, c := range schema.Compound {
+		keys = append(keys, multiKeys(doc, c.key(), c, path, postfix)...)
+	}
+	keys = append(keys, partialKeys(doc, schema.Partial, keys, model, path, postfix)...)
+	return keys, nil
 }
 
-func (DB *DB) indexI(ctx context.Context, obj any, path []byte, postfix []byte, creating bool) error {
+// indexI collects the index keys of obj at path.
+// all is false if only struct fields tagged kane:"index" are indexed, see Schema
+func (DB *DB) indexI(obj any, path []byte, postfix []byte, all bool, keys *[][]byte) error {
 	if obj == nil {
 		return nil
 	}
@@ -38,7 +70,7 @@ func (DB *DB) indexI(ctx context.Context, obj any, path []byte, postfix []byte,
 	switch v := obj.(type) {
 	case []interface{}:
 		for _, v := range v {
-			err := DB.indexI(ctx, v, path, postfix, creating)
+			err := DB.indexI(v, path, postfix, all, keys)
 			if err != nil {
 				return err
 			}
@@ -67,7 +99,7 @@ func (DB *DB) indexI(ctx context.Context, obj any, path []byte, postfix []byte,
 					path2 = append(path2, '.')
 				}
 				path2 = append(path2, kbin...)
-				err := DB.indexI(ctx, v, path2, postfix, creating)
+				err := DB.indexI(v, path2, postfix, all, keys)
 				if err != nil {
 					return err
 				}
@@ -94,7 +126,7 @@ func (DB *DB) indexI(ctx context.Context, obj any, path []byte, postfix []byte,
 					path2 = append(path2, '.')
 				}
 				path2 = append(path2, kbin...)
-				err := DB.indexI(ctx, v, path2, postfix, creating)
+				err := DB.indexI(v, path2, postfix, all, keys)
 				if err != nil {
 					return err
 				}
@@ -108,20 +140,188 @@ func (DB *DB) indexI(ctx context.Context, obj any, path []byte, postfix []byte,
 		pathW := append(bytes.Clone(path), 0xff)
 		pathW = append(pathW, vbin...)
 		pathW = append(pathW, postfix...)
-		if creating {
-			DB.KV.Set(ctx, pathW, []byte{0xff})
-		} else {
-			DB.KV.Del(ctx, pathW)
-		}
+		*keys = append(*keys, pathW)
 
 	default:
-		return DB.indexStruct(ctx, obj, path, postfix, creating)
+		return DB.indexStruct(obj, path, postfix, all, keys)
 	}
 
 	return nil
 }
 
+// indexVal encodes a value so that the byte order of the encoding is the order of the values,
+// as long as they are of the same kind.
+//
+// all numbers share one encoding regardless of their go type, so 2, uint8(2) and 2.0 are equal.
+// it is the float64 value with its bits flipped into sortable order, followed by the signed
+// distance of an integer to that float64, which keeps integers beyond 2^53 exact.
+// -0 is stored as 0. NaN has no order and cannot be indexed.
+//
+// strings and bytes are escaped so they never contain 0x00 or 0xff and are terminated by 0x00,
+// which sorts "ab" before "abc" and makes the encoding self delimiting.
 func indexVal(val any) ([]byte, error) {
+	switch v := val.(type) {
+	case []byte:
+		if len(v) > 1024 {
+			return nil, fmt.Errorf("string too long for index")
+		}
+		for _, ch := range v {
+			if ch == 0xff {
+				return nil, fmt.Errorf("invalid string")
+			}
+		}
+		return escapeVal(ValueBinary, v), nil
+
+	case string:
+		if len(v) > 1024 {
+			return nil, fmt.Errorf("string too long for index")
+		}
+		for _, ch := range []byte(v) {
+			if ch == 0xff {
+				return nil, fmt.Errorf("invalid string")
+			}
+		}
+		return escapeVal(ValueText, []byte(v)), nil
+
+	case json.Number:
+		if i64, err := v.Int64(); err == nil {
+			return indexVal(i64)
+		} else if u64, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return indexVal(u64)
+		} else if f64, err := v.Float64(); err == nil {
+			return indexVal(f64)
+		}
+	case float32:
+		return floatVal(float64(v))
+	case float64:
+		return floatVal(v)
+	case int:
+		return intVal(int64(v)), nil
+	case int8:
+		return intVal(int64(v)), nil
+	case int16:
+		return intVal(int64(v)), nil
+	case int32:
+		return intVal(int64(v)), nil
+	case int64:
+		return intVal(v), nil
+	case uint:
+		return uintVal(uint64(v)), nil
+	case uint8:
+		return uintVal(uint64(v)), nil
+	case uint16:
+		return uintVal(uint64(v)), nil
+	case uint32:
+		return uintVal(uint64(v)), nil
+	case uint64:
+		return uintVal(v), nil
+	case bool:
+		vbin := make([]byte, 2)
+		vbin[0] = ValueBool
+		if v {
+			vbin[1] = 1
+		}
+		return vbin, nil
+	}
+
+	return nil, fmt.Errorf("%T cannot be used in index", val)
+}
+
+func numberVal(f float64, delta int64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+
+	vbin := make([]byte, 17)
+	vbin[0] = ValueNumber
+	binary.BigEndian.PutUint64(vbin[1:], bits)
+	binary.BigEndian.PutUint64(vbin[9:], uint64(delta)^(1<<63))
+	return vbin
+}
+
+func floatVal(v float64) ([]byte, error) {
+	if math.IsNaN(v) {
+		return nil, fmt.Errorf("NaN cannot be used in index")
+	}
+	if v == 0 {
+		v = 0 // -0
+	}
+	return numberVal(v, 0), nil
+}
+
+func intVal(v int64) []byte {
+	f := float64(v)
+	if f >= math.MaxInt64 {
+		// rounded up to 2^63, which does not fit into int64
+		return numberVal(f, v-math.MaxInt64-1)
+	}
+	return numberVal(f, v-int64(f))
+}
+
+func uintVal(v uint64) []byte {
+	if v <= math.MaxInt64 {
+		return intVal(int64(v))
+	}
+	f := float64(v)
+	if f >= math.MaxUint64 {
+		// rounded up to 2^64, which does not fit into uint64
+		return numberVal(f, int64(v))
+	}
+	return numberVal(f, int64(v-uint64(f)))
+}
+
+func escapeVal(typ byte, v []byte) []byte {
+	vbin := make([]byte, 0, len(v)+2)
+	vbin = append(vbin, typ)
+	for _, ch := range v {
+		if ch < 0xfd {
+			vbin = append(vbin, ch+1)
+		} else {
+			vbin = append(vbin, 0xfe, ch-0xfc)
+		}
+	}
+	return append(vbin, 0x00)
+}
+
+// validIndexVal tells if vbin is a value in the encoding of the current IndexVersion
+func validIndexVal(vbin []byte) bool {
+	if len(vbin) == 0 {
+		return false
+	}
+
+	switch vbin[0] {
+	case ValueNumber:
+		return len(vbin) == 17
+	case ValueBool:
+		return len(vbin) == 2 && vbin[1] <= 1
+	case ValueText, ValueBinary:
+		end := len(vbin) - 1
+		if end < 1 || vbin[end] != 0x00 {
+			return false
+		}
+		for i := 1; i < end; i++ {
+			switch vbin[i] {
+			case 0x00, 0xff:
+				return false
+			case 0xfe:
+				i++
+				if i >= end || vbin[i] < 1 || vbin[i] > 3 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// indexValV1 is the index encoding before IndexVersion 2.
+// it does not preserve order for negative numbers or floats, and floats lose their fraction.
+// primary keys still use it, so that k keys never need to be migrated.
+func indexValV1(val any) ([]byte, error) {
 	switch v := val.(type) {
 	case []byte:
 		if len(v) > 1024 {
@@ -151,9 +351,9 @@ func indexVal(val any) ([]byte, error) {
 
 	case json.Number:
 		if i64, err := v.Int64(); err == nil {
-			return indexVal(i64)
+			return indexValV1(i64)
 		} else if f64, err := v.Float64(); err == nil {
-			return indexVal(f64)
+			return indexValV1(f64)
 		}
 	case float32:
 		vbin := make([]byte, 10)
@@ -247,8 +447,9 @@ func indexVal(val any) ([]byte, error) {
 	return nil, fmt.Errorf("%T cannot be used in index", val)
 }
 
-// indexStruct handles struct and struct pointer types similar to how json.Marshal would encode them
-func (DB *DB) indexStruct(ctx context.Context, obj any, path []byte, postfix []byte, creating bool) error {
+// indexStruct handles struct and struct pointer types similar to how json.Marshal would encode them.
+// fields tagged kane:"noindex" are skipped, and so are fields not tagged kane:"index" unless all is true
+func (DB *DB) indexStruct(obj any, path []byte, postfix []byte, all bool, keys *[][]byte) error {
 	v := reflect.ValueOf(obj)
 
 	// Handle pointers by dereferencing them
@@ -281,17 +482,17 @@ func (DB *DB) indexStruct(ctx context.Context, obj any, path []byte, postfix []b
 			continue
 		}
 
-		// Process json tag to get field name
-		jsonTag := field.Tag.Get("json")
-		if jsonTag == "-" {
-			// Skip fields explicitly marked to be excluded
+		// Process json tag to get field name, skipping fields explicitly marked to be excluded
+		fieldName, ok := jsonFieldName(field)
+		if !ok {
 			continue
 		}
 
-		fieldName := field.Name
-		parts := strings.Split(jsonTag, ",")
-		if len(parts) > 0 && parts[0] != "" {
-			fieldName = parts[0]
+		// Process kane tag. untagged structs are still walked for tagged fields
+		tag := parseFieldTag(field)
+		fieldAll := all || tag.index || tag.unique
+		if tag.noindex || (!fieldAll && !isStructType(field.Type)) {
+			continue
 		}
 
 		// Check if fieldName contains 0xff
@@ -316,7 +517,7 @@ func (DB *DB) indexStruct(ctx context.Context, obj any, path []byte, postfix []b
 
 		// Get the field value and index it
 		fieldInterface := fieldValue.Interface()
-		err := DB.indexI(ctx, fieldInterface, path2, postfix, creating)
+		err := DB.indexI(fieldInterface, path2, postfix, fieldAll, keys)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,84 @@
+package kane
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestIndexValOrder(t *testing.T) {
+	ordered := []any{
+		math.Inf(-1),
+		int64(math.MinInt64),
+		int64(math.MinInt64 + 1),
+		-1e18,
+		-1.5,
+		-1,
+		-0.5,
+		0,
+		0.5,
+		uint8(1),
+		1.2,
+		1.9,
+		int64(1 << 53),
+		int64(1<<53 + 1),
+		int64(math.MaxInt64 - 1),
+		int64(math.MaxInt64),
+		uint64(math.MaxInt64 + 1),
+		uint64(math.MaxUint64 - 1),
+		uint64(math.MaxUint64),
+		math.Inf(1),
+	}
+
+	for i := 1; i < len(ordered); i++ {
+		a, err := indexVal(ordered[i-1])
+		if err != nil {
+			t.Fatalf("indexVal(%v): %v", ordered[i-1], err)
+		}
+		b, err := indexVal(ordered[i])
+		if err != nil {
+			t.Fatalf("indexVal(%v): %v", ordered[i], err)
+		}
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("expected %v < %v", ordered[i-1], ordered[i])
+		}
+	}
+
+	strs := []string{"", "\x00", "\x00\x00", "a", "a\x00", "ab", "abc", "b", "\xfc", "\xfd", "\xfe"}
+	for i := 1; i < len(strs); i++ {
+		a, _ := indexVal(strs[i-1])
+		b, _ := indexVal(strs[i])
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("expected %q < %q", strs[i-1], strs[i])
+		}
+		if bytes.IndexByte(b, 0xff) >= 0 {
+			t.Errorf("encoding of %q contains 0xff", strs[i])
+		}
+	}
+}
+
+func TestIndexValEqual(t *testing.T) {
+	equal := [][]any{
+		{0, 0.0, math.Copysign(0, -1), uint(0)},
+		{2, int8(2), uint64(2), float32(2), 2.0},
+		{-3, int16(-3), -3.0},
+	}
+
+	for _, vals := range equal {
+		first, _ := indexVal(vals[0])
+		for _, v := range vals[1:] {
+			b, err := indexVal(v)
+			if err != nil {
+				t.Fatalf("indexVal(%v): %v", v, err)
+			}
+			if !bytes.Equal(first, b) {
+				t.Errorf("expected %T(%v) to encode like %T(%v)", v, v, vals[0], vals[0])
+			}
+		}
+	}
+
+	_, err := indexVal(math.NaN())
+	if err == nil {
+		t.Error("expected NaN to be rejected")
+	}
+}
@@ -1,46 +1,274 @@
 package kane
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"iter"
 	"reflect"
+	"slices"
+
+	"github.com/aep/kane/kv"
 )
 
-func Iter[Val any](ctx context.Context, DB *DB, op Filter) iter.Seq2[Val, error] {
+func Iter[Val any](ctx context.Context, DB *DB, op Filter, opts ...Opt) iter.Seq2[Val, error] {
 	var val Val
 	model := getModelFromAny(val)
 
 	return func(yield func(Val, error) bool) {
-		for id, err := range DB.find(ctx, model, op) {
+		q := parseOpts(opts)
+
+		var after []byte
+		if q.cursor != nil && *q.cursor != "" {
+			var err error
+			after, err = base64.RawURLEncoding.DecodeString(*q.cursor)
+			if err != nil {
+				var rval Val
+				yield(rval, fmt.Errorf("invalid cursor: %w", err))
+				return
+			}
+		}
+
+		size := q.batchSize
+		if q.limit > 0 && q.limit < size {
+			size = q.limit
+		}
+
+		n := 0
+		skipped := 0
+		for chunk := range DB.fetch(ctx, DB.find(ctx, model, docType(val), op, q, after), size) {
 
 			var rval Val
+			if chunk.err != nil {
+				yield(rval, chunk.err)
+				return
+			}
+
+			rvals := make([]Val, len(chunk.hits))
+			docs := make([]*StoredDocument, len(chunk.hits))
+			errs := make([]error, len(chunk.hits))
+
+			for i, h := range chunk.hits {
+				b := chunk.vals[i]
+				if b == nil {
+					// the object may have been deleted since it was found,
+					// which is only an error if the index still points to it
+					dangling, err := DB.stillIndexed(ctx, h)
+					if err != nil {
+						yield(rval, err)
+						return
+					}
+					if dangling {
+						errs[i] = ErrNotFound
+					}
+					continue
+				}
+
+				var doc *StoredDocument
+				if reflect.TypeOf(rval) == reflect.TypeOf(StoredDocument{}) {
+					doc = any(&rvals[i]).(*StoredDocument)
+				} else {
+					doc = &StoredDocument{Val: &rvals[i]}
+				}
+				errs[i] = deserializeStore(b, doc)
+				if errs[i] != nil {
+					continue
+				}
+				if doc.Version == 0 {
+					doc.Version = binary.LittleEndian.Uint64(h.id)
+				}
+				docs[i] = doc
+			}
+
+			current, err := DB.verify(ctx, model, op, chunk.hits, docs)
 			if err != nil {
-				if !yield(rval, err) {
+				yield(rval, err)
+				return
+			}
+
+			for i, h := range chunk.hits {
+				if q.limit > 0 && n >= q.limit {
+					return
+				}
+
+				rval := rvals[i]
+				err := errs[i]
+				if err == nil && !current[i] {
+					continue
+				}
+
+				if err != nil {
+					oerr := &ObjectError{Model: model, ID: h.id, Err: err}
+					if q.lenient == nil {
+						yield(rval, oerr)
+						return
+					}
+					skipped++
+					if q.lenient.onSkip != nil {
+						q.lenient.onSkip(skipped, oerr)
+					}
+					continue
+				}
+
+				n++
+				if q.cursor != nil {
+					*q.cursor = base64.RawURLEncoding.EncodeToString(h.pos)
+				}
+				if !yield(rval, nil) {
 					return
 				}
 			}
+		}
 
-			path2 := append([]byte{'o', 0xff}, id...)
-			path2 = append(path2, 0xff)
+		if q.cursor != nil {
+			*q.cursor = ""
+		}
+	}
+}
 
-			b, err := DB.KV.Get(ctx, path2)
-			if err != nil {
-				continue
+// verify tells for each loaded document if it is still the current version of its primary key,
+// and still matches op and has the index key it was found at. otherwise it was found through
+// an index key that is left over from a previous version, or a crashed write, see GC.
+// nil documents are not current. documents without a primary key cannot be checked and are.
+func (DB *DB) verify(ctx context.Context, model string, op Filter, hits []hit, docs []*StoredDocument) ([]bool, error) {
+	current := make([]bool, len(hits))
+
+	var idx []int
+	var paths [][]byte
+	for i, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		pk, err := getPKFromAny(doc)
+		if err != nil {
+			// nothing to check against, for example Iter[StoredDocument]
+			current[i] = true
+			continue
+		}
+
+		keys, err := DB.indexKeys(doc, []byte(model), hits[i].id)
+		if err != nil || !op.matches(indexPrefix(model), keys) {
+			continue
+		}
+		if len(hits[i].key) > 0 && hits[i].key[0] == 'f' &&
+			!slices.ContainsFunc(keys, func(k []byte) bool { return bytes.Equal(k, hits[i].key) }) {
+			continue
+		}
+
+		path := append([]byte{'k', 0xff}, model...)
+		path = append(path, 0xff)
+		path = append(path, pk...)
+		path = append(path, 0xff)
+		idx = append(idx, i)
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return current, nil
+	}
+
+	ptrs, err := DB.KV.BatchGet(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range idx {
+		current[i] = len(ptrs[j]) >= 8 && bytes.Equal(ptrs[j][:8], hits[i].id)
+	}
+	return current, nil
+}
+
+// stillIndexed tells if the index key a hit was found at still points to its object
+func (DB *DB) stillIndexed(ctx context.Context, h hit) (bool, error) {
+	if len(h.key) == 0 {
+		return false, nil
+	}
+
+	v, err := DB.KV.Get(ctx, h.key)
+	if errors.Is(err, kv.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// found through the primary key pointer, which may have moved on to a newer object
+	if h.key[0] == 'k' {
+		return len(v) >= 8 && bytes.Equal(v[:8], h.id), nil
+	}
+	return true, nil
+}
+
+// chunk is a batch of found ids with their objects, or an error
+type chunk struct {
+	hits []hit
+	vals [][]byte
+	err  error
+}
+
+// fetch loads the objects of ids with one BatchGet per size ids.
+// the next chunk is loaded in the background while the caller works on the current one.
+func (DB *DB) fetch(ctx context.Context, ids hits, size int) iter.Seq[chunk] {
+	return func(yield func(chunk) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		ch := make(chan chunk)
+
+		go func() {
+			defer close(ch)
+
+			send := func(c chunk) bool {
+				select {
+				case ch <- c:
+					return true
+				case <-ctx.Done():
+					return false
+				}
 			}
 
-			var doc *StoredDocument
-			if reflect.TypeOf(rval) == reflect.TypeOf(StoredDocument{}) {
-				doc = any(&rval).(*StoredDocument)
-			} else {
-				doc = &StoredDocument{Val: &rval}
+			var batch []hit
+			flush := func() bool {
+				if len(batch) == 0 {
+					return true
+				}
+				keys := make([][]byte, len(batch))
+				for i, h := range batch {
+					path := append([]byte{'o', 0xff}, h.id...)
+					keys[i] = append(path, 0xff)
+				}
+				vals, err := DB.KV.BatchGet(ctx, keys)
+				if err == nil && len(vals) != len(keys) {
+					err = fmt.Errorf("BatchGet returned %d values for %d keys", len(vals), len(keys))
+				}
+				c := chunk{hits: batch, vals: vals, err: err}
+				batch = nil
+				return send(c)
 			}
 
-			err = deserializeStore(b, doc)
-			if err != nil {
-				continue
+			for h, err := range ids {
+				if err != nil {
+					if !flush() || !send(chunk{err: err}) {
+						return
+					}
+					continue
+				}
+				batch = append(batch, h)
+				if len(batch) >= size && !flush() {
+					return
+				}
+			}
+			flush()
+		}()
+
+		// stop the background fetch and wait for it, so nothing outlives the iteration
+		defer func() {
+			cancel()
+			for range ch {
 			}
+		}()
 
-			if !yield(rval, nil) {
+		for c := range ch {
+			if !yield(c) {
 				return
 			}
 		}
@@ -2,6 +2,9 @@ package kane
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
@@ -123,6 +126,244 @@ func TestIterOperations(t *testing.T) {
 			}
 		})
 
+		t.Run("IterInBatches", func(t *testing.T) {
+			// Batches smaller than the result, ending on a partial batch
+			var names []string
+			for doc, err := range Iter[IterTestDoc](ctx, db, Has("ID"), OrderBy("Age", Asc), BatchSize(2)) {
+				if err != nil {
+					t.Fatalf("Iteration error: %v", err)
+				}
+				names = append(names, doc.Name)
+			}
+
+			expected := []string{"Alice", "Bob", "Charlie", "Dave", "Eve"}
+			if len(names) != len(expected) {
+				t.Fatalf("Expected %v, got %v", expected, names)
+			}
+			for i := range expected {
+				if names[i] != expected[i] {
+					t.Fatalf("Expected %v, got %v", expected, names)
+				}
+			}
+
+			// Stopping early while the next batch is being fetched
+			count := 0
+			for _, err := range Iter[IterTestDoc](ctx, db, Has("ID"), BatchSize(1)) {
+				if err != nil {
+					t.Fatalf("Iteration error: %v", err)
+				}
+				count++
+				if count == 2 {
+					break
+				}
+			}
+			if count != 2 {
+				t.Errorf("Expected to stop after 2 documents, got %d", count)
+			}
+
+			// Writing while iterating does not block the background fetch
+			extra := []*IterTestDoc{
+				{ID: "iter-test-6", Name: "Frank", Age: 50},
+				{ID: "iter-test-7", Name: "Grace", Age: 55},
+			}
+			for _, doc := range extra {
+				if err := db.Put(ctx, doc); err != nil {
+					t.Fatalf("Failed to put document %s: %v", doc.ID, err)
+				}
+			}
+			count = 0
+			for doc, err := range Iter[IterTestDoc](ctx, db, Gte("Age", 50), OrderBy("Age", Asc), BatchSize(10)) {
+				if err != nil {
+					t.Fatalf("Iteration error: %v", err)
+				}
+				count++
+				if err := db.Del(ctx, &doc); err != nil {
+					t.Fatalf("Failed to delete document %s: %v", doc.ID, err)
+				}
+			}
+			if count != 2 {
+				t.Errorf("Expected 2 documents, got %d", count)
+			}
+		})
+
+		t.Run("IterBrokenObjects", func(t *testing.T) {
+			broken := []*IterTestDoc{
+				{ID: "iter-test-corrupt", Name: "Corrupt", Age: 60},
+				{ID: "iter-test-dangling", Name: "Dangling", Age: 61},
+			}
+			var paths [][]byte
+			for _, doc := range broken {
+				if err := db.Put(ctx, doc); err != nil {
+					t.Fatalf("Failed to put document %s: %v", doc.ID, err)
+				}
+				for h, err := range db.find(ctx, "IterTestDoc", nil, Eq("ID", doc.ID), queryOpts{}, nil) {
+					if err != nil {
+						t.Fatalf("Failed to find document %s: %v", doc.ID, err)
+					}
+					path := append([]byte{'o', 0xff}, h.id...)
+					paths = append(paths, append(path, 0xff))
+				}
+			}
+			if len(paths) != 2 {
+				t.Fatalf("Expected 2 objects, got %d", len(paths))
+			}
+			var originals [][]byte
+			for _, path := range paths {
+				b, err := db.KV.Get(ctx, path)
+				if err != nil {
+					t.Fatalf("Failed to read object: %v", err)
+				}
+				originals = append(originals, b)
+			}
+			if err := db.KV.Set(ctx, paths[0], []byte("not json")); err != nil {
+				t.Fatalf("Failed to corrupt object: %v", err)
+			}
+			if err := db.KV.Del(ctx, paths[1]); err != nil {
+				t.Fatalf("Failed to delete object: %v", err)
+			}
+
+			// Strict by default: stop at the first broken object
+			var oerr *ObjectError
+			for _, err := range Iter[IterTestDoc](ctx, db, Gte("Age", 60), OrderBy("Age", Asc)) {
+				if !errors.As(err, &oerr) {
+					t.Fatalf("Expected ObjectError, got %v", err)
+				}
+			}
+			if oerr == nil || oerr.Model != "IterTestDoc" || errors.Is(oerr, ErrNotFound) {
+				t.Errorf("Expected decode error for the corrupt object, got %v", oerr)
+			}
+
+			oerr = nil
+			for _, err := range Iter[IterTestDoc](ctx, db, Eq("ID", "iter-test-dangling")) {
+				if !errors.As(err, &oerr) {
+					t.Fatalf("Expected ObjectError, got %v", err)
+				}
+			}
+			if oerr == nil || !errors.Is(oerr, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for the dangling index entry, got %v", oerr)
+			}
+
+			// Lenient: skip and report them, and keep going
+			skipped := 0
+			count := 0
+			for _, err := range Iter[IterTestDoc](ctx, db, Gte("Age", 45), Lenient(func(n int, err *ObjectError) {
+				skipped = n
+			})) {
+				if err != nil {
+					t.Fatalf("Iteration error: %v", err)
+				}
+				count++
+			}
+			if count != 1 || skipped != 2 {
+				t.Errorf("Expected 1 document and 2 skipped, got %d and %d skipped", count, skipped)
+			}
+
+			// Objects deleted while iterating are not broken
+			doc := &IterTestDoc{ID: "iter-test-deleted", Name: "Deleted", Age: 62}
+			if err := db.Put(ctx, doc); err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			for h, err := range db.find(ctx, "IterTestDoc", nil, Eq("ID", doc.ID), queryOpts{}, nil) {
+				if err != nil {
+					t.Fatalf("Failed to find document: %v", err)
+				}
+				if err := db.Del(ctx, doc); err != nil {
+					t.Fatalf("Failed to delete document: %v", err)
+				}
+				dangling, err := db.stillIndexed(ctx, h)
+				if err != nil || dangling {
+					t.Errorf("Expected deleted object not to be dangling, got %v %v", dangling, err)
+				}
+			}
+
+			// Repair the objects so they can be deleted normally
+			for i, path := range paths {
+				if err := db.KV.Set(ctx, path, originals[i]); err != nil {
+					t.Fatalf("Failed to restore object: %v", err)
+				}
+				if err := db.Del(ctx, broken[i]); err != nil {
+					t.Fatalf("Failed to delete document %s: %v", broken[i].ID, err)
+				}
+			}
+		})
+
+		t.Run("IterStaleHits", func(t *testing.T) {
+			doc := &IterTestDoc{ID: "iter-test-stale", Name: "Current", Age: 70}
+			if err := db.Put(ctx, doc); err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			pk, _ := getPKFromAny(doc)
+			ptr, err := db.KV.Get(ctx, append(append([]byte("k\xffIterTestDoc\xff"), pk...), 0xff))
+			if err != nil {
+				t.Fatalf("Failed to read pointer: %v", err)
+			}
+
+			// an index key the document no longer has, left over from a crashed write
+			ghost := &IterTestDoc{ID: doc.ID, Name: "Ghost", Age: doc.Age}
+			ghostKeys, err := db.indexKeys(&StoredDocument{Val: ghost}, []byte("IterTestDoc"), ptr)
+			if err != nil {
+				t.Fatalf("Failed to get index keys: %v", err)
+			}
+
+			// an older object of the same document that was never cleaned up
+			oldOid := binary.LittleEndian.AppendUint64(nil, 1)
+			old := &IterTestDoc{ID: doc.ID, Name: "Old", Age: doc.Age}
+			oldKeys, err := db.indexKeys(&StoredDocument{Val: old}, []byte("IterTestDoc"), oldOid)
+			if err != nil {
+				t.Fatalf("Failed to get index keys: %v", err)
+			}
+			ob, err := serializeStore(&StoredDocument{Val: old})
+			if err != nil {
+				t.Fatalf("Failed to serialize: %v", err)
+			}
+			db.KV.Set(ctx, objectPath(oldOid), ob)
+			for _, k := range append(ghostKeys, oldKeys...) {
+				db.KV.Set(ctx, k, []byte{0xff})
+			}
+
+			for _, tc := range []struct {
+				op   Filter
+				want []string
+			}{
+				{Eq("Name", "Ghost"), nil},
+				{Eq("Name", "Old"), nil},
+				{Eq("ID", doc.ID), []string{"Current"}},
+				{Eq("Age", 70), []string{"Current"}},
+				{Has("Age"), []string{"Alice", "Bob", "Charlie", "Dave", "Eve", "Current"}},
+			} {
+				var names []string
+				for d, err := range Iter[IterTestDoc](ctx, db, tc.op, OrderBy("Age", Asc), BatchSize(2)) {
+					if err != nil {
+						t.Fatalf("Iteration error: %v", err)
+					}
+					names = append(names, d.Name)
+				}
+				if fmt.Sprint(names) != fmt.Sprint(tc.want) {
+					t.Errorf("Expected %v, got %v", tc.want, names)
+				}
+			}
+
+			// Get skips the old object, which is found first
+			var got IterTestDoc
+			if err := db.Get(ctx, &got, Eq("Age", 70)); err != nil {
+				t.Fatalf("Failed to get document: %v", err)
+			}
+			if got.Name != "Current" {
+				t.Errorf("Expected the current version, got %q", got.Name)
+			}
+			if err := db.Get(ctx, &got, Eq("Name", "Ghost")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for a stale index key, got %v", err)
+			}
+
+			for _, k := range append(ghostKeys, oldKeys...) {
+				db.KV.Del(ctx, k)
+			}
+			db.KV.Del(ctx, objectPath(oldOid))
+			if err := db.Del(ctx, doc); err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+		})
+
 		// Clean up test documents
 		for _, doc := range docs {
 			err := db.Del(ctx, doc)
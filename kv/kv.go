@@ -2,12 +2,17 @@ package kv
 
 import (
 	"context"
+	"errors"
 	"io"
 	"iter"
+	"time"
 )
 
 type Opt any
 
+// ErrNotFound is returned by Get when the key does not exist, regardless of the backend
+var ErrNotFound = errors.New("not found")
+
 type KeyAndValue struct {
 	K []byte
 	V []byte
@@ -23,6 +28,7 @@ type KV interface {
 
 	CAS(ctx context.Context, key, previousValue, newValue []byte, opts ...Opt) ([]byte, bool, error)
 
+	// BatchGet returns one value per key, in the same order. the value of a key that does not exist is nil
 	BatchGet(ctx context.Context, keys [][]byte, opts ...Opt) ([][]byte, error)
 	Iter(ctx context.Context, srart []byte, end []byte, opts ...Opt) iter.Seq2[KeyAndValue, error]
 	IterKeys(ctx context.Context, srart []byte, end []byte, opts ...Opt) iter.Seq2[[]byte, error]
@@ -30,6 +36,25 @@ type KV interface {
 	GetVectorTime(ctx context.Context) (uint64, error)
 }
 
+// VectorTimeToTime returns the wall clock time a timestamp from GetVectorTime was taken at.
+// timestamps are milliseconds since the epoch shifted left by 18 bits, plus a logical counter.
+func VectorTimeToTime(ts uint64) time.Time {
+	return time.UnixMilli(int64(ts >> 18)).UTC()
+}
+
+// pass Reverse to Iter or IterKeys to yield keys from end to start.
+// end is still exclusive and start inclusive.
+type Reverse struct{}
+
+func isReverse(opts []Opt) bool {
+	for _, opt := range opts {
+		if _, ok := opt.(Reverse); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // as an optimization, pass a pointer to a Lifetime, which must be Close()'d when done with the value
 type Lifetime struct{ closers []io.Closer }
 
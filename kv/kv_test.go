@@ -3,10 +3,12 @@ package kv
 import (
 	"bytes"
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestPebbleKV(t *testing.T) {
@@ -74,8 +76,8 @@ func runKVTests(t *testing.T, store KV) {
 
 		// Verify key is gone
 		_, err = store.Get(ctx, key)
-		if err == nil {
-			t.Errorf("Key should be deleted but still exists")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Key should be deleted but got %v", err)
 		}
 	})
 
@@ -145,6 +147,24 @@ func runKVTests(t *testing.T, store KV) {
 				t.Fatalf("Del failed: %v", err)
 			}
 		}
+
+		// Missing keys keep their position
+		if err := store.Set(ctx, keys[1], values[1]); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		retrievedValues, err = store.BatchGet(ctx, keys)
+		if err != nil {
+			t.Fatalf("BatchGet failed: %v", err)
+		}
+		if len(retrievedValues) != len(keys) {
+			t.Fatalf("BatchGet returned wrong number of values: got %d, want %d", len(retrievedValues), len(keys))
+		}
+		if retrievedValues[0] != nil || !bytes.Equal(retrievedValues[1], values[1]) || retrievedValues[2] != nil {
+			t.Errorf("BatchGet returned wrong values for missing keys: got %q", retrievedValues)
+		}
+		if err := store.Del(ctx, keys[1]); err != nil {
+			t.Fatalf("Del failed: %v", err)
+		}
 	})
 
 	t.Run("CAS", func(t *testing.T) {
@@ -364,10 +384,111 @@ func runKVTests(t *testing.T, store KV) {
 		}
 	})
 
+	t.Run("IterNested", func(t *testing.T) {
+		key := []byte("nested-key")
+		if err := store.Set(ctx, key, []byte("nested-value")); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+
+		// a write and another iterator inside an iterator, like a query that repairs what it reads
+		done := make(chan error, 1)
+		go func() {
+			for _, err := range store.Iter(ctx, key, append(key, 0xff)) {
+				if err != nil {
+					done <- err
+					return
+				}
+				if _, _, err := store.CAS(ctx, key, []byte("nested-value"), []byte("nested-value2")); err != nil {
+					done <- err
+					return
+				}
+				for _, err := range store.IterKeys(ctx, key, append(key, 0xff)) {
+					if err != nil {
+						done <- err
+						return
+					}
+				}
+			}
+			done <- nil
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Nested iteration failed: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Writing while iterating deadlocked")
+		}
+
+		if err := store.Del(ctx, key); err != nil {
+			t.Fatalf("Del failed: %v", err)
+		}
+	})
+
+	t.Run("ReverseIter", func(t *testing.T) {
+		keys := [][]byte{
+			[]byte("reverse-key1"),
+			[]byte("reverse-key2"),
+			[]byte("reverse-key3"),
+		}
+
+		for _, key := range keys {
+			if err := store.Set(ctx, key, key); err != nil {
+				t.Fatalf("Set failed for key %q: %v", key, err)
+			}
+		}
+
+		start := []byte("reverse-key1")
+		end := []byte("reverse-key3") // end is still exclusive
+
+		var got [][]byte
+		for kv, err := range store.Iter(ctx, start, end, Reverse{}) {
+			if err != nil {
+				t.Fatalf("Iter returned error: %v", err)
+			}
+			got = append(got, kv.K)
+		}
+
+		if len(got) != 2 || !bytes.Equal(got[0], keys[1]) || !bytes.Equal(got[1], keys[0]) {
+			t.Errorf("Reverse Iter returned %q, want %q", got, [][]byte{keys[1], keys[0]})
+		}
+
+		var gotKeys [][]byte
+		for key, err := range store.IterKeys(ctx, start, []byte("reverse-kez"), Reverse{}) {
+			if err != nil {
+				t.Fatalf("IterKeys returned error: %v", err)
+			}
+			gotKeys = append(gotKeys, key)
+		}
+
+		if len(gotKeys) != 3 || !bytes.Equal(gotKeys[0], keys[2]) || !bytes.Equal(gotKeys[2], keys[0]) {
+			t.Errorf("Reverse IterKeys returned %q", gotKeys)
+		}
+
+		for _, key := range keys {
+			if err := store.Del(ctx, key); err != nil {
+				t.Fatalf("Del failed: %v", err)
+			}
+		}
+	})
+
 	t.Run("GetVectorTime", func(t *testing.T) {
-		_, err := store.GetVectorTime(ctx)
+		ts1, err := store.GetVectorTime(ctx)
 		if err != nil {
 			t.Logf("GetVectorTime returned error (expected for some implementations): %v", err)
+			return
+		}
+		ts2, err := store.GetVectorTime(ctx)
+		if err != nil {
+			t.Fatalf("GetVectorTime failed: %v", err)
+		}
+		if ts2 <= ts1 {
+			t.Errorf("GetVectorTime went backwards: %d then %d", ts1, ts2)
+		}
+
+		if d := time.Since(VectorTimeToTime(ts2)); d < -time.Minute || d > time.Minute {
+			t.Errorf("VectorTimeToTime is %v away from now", d)
 		}
 	})
 }
@@ -3,21 +3,28 @@ package kv
 import (
 	"bytes"
 	"context"
+	"errors"
 	"iter"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 )
 
 type PebbleKV struct {
-	db         *pebble.DB
-	mu         sync.RWMutex  // Global RWLock to protect CAS
-	vectorTime atomic.Uint64 // Vector time counter
+	db            *pebble.DB
+	mu            sync.RWMutex  // Global RWLock to protect CAS
+	vectorTime    atomic.Uint64 // Vector time counter
+	persistedTime atomic.Uint64 // Last vector time written to disk
 }
 
+// the vector time is persisted about once per second of physical time,
+// and restarts this far ahead of the persisted value in case the clock went backwards
+const vectorTimePersistInterval = 1000 << 18
+
 func NewPebble(path string) (KV, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return nil, err
@@ -43,7 +50,7 @@ func NewPebble(path string) (KV, error) {
 				uint64(value[5])<<40 |
 				uint64(value[6])<<48 |
 				uint64(value[7])<<56
-			pKV.vectorTime.Store(currentValue + 100)
+			pKV.vectorTime.Store(currentValue + vectorTimePersistInterval)
 		}
 		closer.Close()
 	} else if err != pebble.ErrNotFound {
@@ -67,6 +74,9 @@ func (p *PebbleKV) Get(ctx context.Context, key []byte, opts ...Opt) ([]byte, er
 	defer p.mu.RUnlock()
 
 	value, closer, err := p.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -106,17 +116,17 @@ func (p *PebbleKV) Del(ctx context.Context, key []byte, opts ...Opt) error {
 
 // BatchGet retrieves multiple values for the given keys
 func (p *PebbleKV) BatchGet(ctx context.Context, keys [][]byte, opts ...Opt) ([][]byte, error) {
-	var r [][]byte
+	r := make([][]byte, len(keys))
 
-	for _, key := range keys {
-		value, err := p.Get(ctx, key, opts)
+	for i, key := range keys {
+		value, err := p.Get(ctx, key, opts...)
 		if err != nil {
-			if err == pebble.ErrNotFound {
+			if errors.Is(err, ErrNotFound) {
 				continue
 			}
 			return nil, err
 		}
-		r = append(r, value)
+		r[i] = value
 	}
 
 	return r, nil
@@ -125,9 +135,9 @@ func (p *PebbleKV) BatchGet(ctx context.Context, keys [][]byte, opts ...Opt) ([]
 // Iter returns an iterator that yields key-value pairs in the range [start, end)
 func (p *PebbleKV) Iter(ctx context.Context, start []byte, end []byte, opts ...Opt) iter.Seq2[KeyAndValue, error] {
 	return func(yield func(KeyAndValue, error) bool) {
-		p.mu.RLock()
-		defer p.mu.RUnlock()
-
+		// pebble iterators read from a consistent snapshot and do not need the CAS lock.
+		// holding it would deadlock callers that nest iterators or write while iterating
+		// as soon as a CAS is waiting for the lock.
 		iter, err := p.db.NewIter(&pebble.IterOptions{
 			LowerBound: start,
 			UpperBound: end,
@@ -138,8 +148,10 @@ func (p *PebbleKV) Iter(ctx context.Context, start []byte, end []byte, opts ...O
 		}
 		defer iter.Close()
 
+		next := seek(iter, start, end, opts)
+
 		// Iterate through the range
-		for iter.SeekGE(start); iter.Valid(); iter.Next() {
+		for ; iter.Valid(); next() {
 			// Make copies of key and value
 			key := append([]byte{}, iter.Key()...)
 			val := append([]byte{}, iter.Value()...)
@@ -165,9 +177,7 @@ func (p *PebbleKV) Iter(ctx context.Context, start []byte, end []byte, opts ...O
 // Iter returns an iterator that yields key-value pairs in the range [start, end)
 func (p *PebbleKV) IterKeys(ctx context.Context, start []byte, end []byte, opts ...Opt) iter.Seq2[[]byte, error] {
 	return func(yield func([]byte, error) bool) {
-		p.mu.RLock()
-		defer p.mu.RUnlock()
-
+		// see Iter
 		iter, err := p.db.NewIter(&pebble.IterOptions{
 			LowerBound: start,
 			UpperBound: end,
@@ -178,8 +188,10 @@ func (p *PebbleKV) IterKeys(ctx context.Context, start []byte, end []byte, opts
 		}
 		defer iter.Close()
 
+		next := seek(iter, start, end, opts)
+
 		// Iterate through the range
-		for iter.SeekGE(start); iter.Valid(); iter.Next() {
+		for ; iter.Valid(); next() {
 			if !yield(bytes.Clone(iter.Key()), nil) {
 				return
 			}
@@ -192,6 +204,21 @@ func (p *PebbleKV) IterKeys(ctx context.Context, start []byte, end []byte, opts
 	}
 }
 
+// seek positions iter at the first key of the range [start, end) and returns the function to advance it
+func seek(iter *pebble.Iterator, start []byte, end []byte, opts []Opt) func() bool {
+	if !isReverse(opts) {
+		iter.SeekGE(start)
+		return iter.Next
+	}
+
+	if end == nil {
+		iter.Last()
+	} else {
+		iter.SeekLT(end)
+	}
+	return iter.Prev
+}
+
 func (p *PebbleKV) CAS(ctx context.Context, key, previousValue, newValue []byte, opts ...Opt) ([]byte, bool, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -232,15 +259,32 @@ func (p *PebbleKV) CAS(ctx context.Context, key, previousValue, newValue []byte,
 	return currentValue, true, nil
 }
 
+// GetVectorTime returns timestamps in the same format as the tikv timestamp oracle,
+// so that VectorTimeToTime works for both
 func (p *PebbleKV) GetVectorTime(ctx context.Context) (uint64, error) {
-	// Atomically increment and get the new value
-	newValue := p.vectorTime.Add(1)
+	physical := uint64(time.Now().UnixMilli()) << 18
 
-	if newValue%100 == 0 {
-		go p.persistVectorTime(newValue)
-	}
+	for {
+		oldValue := p.vectorTime.Load()
+
+		// never go backwards, even if the clock does
+		newValue := oldValue + 1
+		if physical > newValue {
+			newValue = physical
+		}
 
-	return newValue, nil
+		if !p.vectorTime.CompareAndSwap(oldValue, newValue) {
+			continue
+		}
+
+		// written in line, a background write could outlive Close
+		if newValue >= p.persistedTime.Load()+vectorTimePersistInterval {
+			p.persistedTime.Store(newValue)
+			p.persistVectorTime(newValue)
+		}
+
+		return newValue, nil
+	}
 }
 
 // persistVectorTime writes the current vector time to disk
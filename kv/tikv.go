@@ -1,6 +1,7 @@
 package kv
 
 import (
+	"bytes"
 	"context"
 	"iter"
 	"log/slog"
@@ -12,7 +13,6 @@ import (
 	"github.com/tikv/client-go/txnkv/oracle"
 	"github.com/tikv/client-go/v2/config"
 
-	tikverr "github.com/tikv/client-go/v2/error"
 	"github.com/tikv/client-go/v2/rawkv"
 
 	"go.opentelemetry.io/otel"
@@ -52,7 +52,7 @@ func (k *Tikv) Get(ctx context.Context, key []byte, opts ...Opt) ([]byte, error)
 		return nil, err
 	}
 	if v == nil {
-		return nil, tikverr.ErrNotExist
+		return nil, ErrNotFound
 	}
 	return v, nil
 }
@@ -80,37 +80,15 @@ func (k *Tikv) Iter(ctx context.Context, start []byte, end []byte, opts ...Opt)
 		_, span := tracer.Start(ctx, "kv.TikvWrite.Iter")
 		defer span.End()
 
-		const batchSize = 100
-
-		currentKey := start
-		for {
-			// Scan from current position to end, with limit
-			keys, values, err := k.k.Scan(ctx, currentKey, end, batchSize)
+		for kv, err := range k.scan(ctx, start, end, isReverse(opts)) {
 			if err != nil {
-				log.Debug("[tikv].Iter: scan error:", "start", string(currentKey), "end", string(end), "err", err)
-				if !yield(KeyAndValue{}, err) {
-					return
-				}
-				break
+				log.Debug("[tikv].Iter: scan error:", "start", string(start), "end", string(end), "err", err)
+				yield(KeyAndValue{}, err)
+				return
 			}
-
-			if len(keys) == 0 {
-				break
-			}
-
-			// Process the batch
-			for i, key := range keys {
-				log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "at", string(key))
-				if !yield(KeyAndValue{K: key, V: values[i]}, nil) {
-					return
-				}
-			}
-
-			currentKey = keys[len(keys)-1]
-			if currentKey[len(currentKey)-1] == 0xff {
-				currentKey = append(currentKey, 0x00)
-			} else {
-				currentKey[len(currentKey)-1] += 1
+			log.Debug("[tikv].Iter:", "start", string(start), "end", string(end), "at", string(kv.K))
+			if !yield(kv, nil) {
+				return
 			}
 		}
 	}
@@ -121,36 +99,63 @@ func (k *Tikv) IterKeys(ctx context.Context, start []byte, end []byte, opts ...O
 		_, span := tracer.Start(ctx, "kv.TikvWrite.Iter")
 		defer span.End()
 
+		for kv, err := range k.scan(ctx, start, end, isReverse(opts), rawkv.ScanKeyOnly()) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(kv.K, nil) {
+				return
+			}
+		}
+	}
+}
+
+// scan pages through [start, end) in batches, in either direction
+func (k *Tikv) scan(ctx context.Context, start []byte, end []byte, reverse bool, opts ...rawkv.RawOption) iter.Seq2[KeyAndValue, error] {
+	return func(yield func(KeyAndValue, error) bool) {
 		const batchSize = 100
 
-		currentKey := start
-		for {
+		if reverse && end == nil {
+			// tikv cannot reverse scan from the end of the keyspace, but no key starts with 0xff
+			end = []byte{0xff}
+		}
 
-			keys, _, err := k.k.Scan(ctx, currentKey, end, batchSize, rawkv.ScanKeyOnly())
+		lower := start
+		upper := end
+		for {
+			var keys, values [][]byte
+			var err error
+			if reverse {
+				keys, values, err = k.k.ReverseScan(ctx, upper, lower, batchSize, opts...)
+			} else {
+				keys, values, err = k.k.Scan(ctx, lower, upper, batchSize, opts...)
+			}
 			if err != nil {
-				if !yield(nil, err) {
-					return
-				}
-				break
+				yield(KeyAndValue{}, err)
+				return
 			}
 
 			if len(keys) == 0 {
-				break
+				return
 			}
 
-			for _, key := range keys {
-				if !yield(key, nil) {
+			for i, key := range keys {
+				var value []byte
+				if i < len(values) {
+					value = values[i]
+				}
+				if !yield(KeyAndValue{K: key, V: value}, nil) {
 					return
 				}
 			}
 
-			currentKey = keys[len(keys)-1]
-			if currentKey[len(currentKey)-1] == 0xff {
-				currentKey = append(currentKey, 0x00)
+			last := keys[len(keys)-1]
+			if reverse {
+				upper = bytes.Clone(last)
 			} else {
-				currentKey[len(currentKey)-1] += 1
+				lower = append(bytes.Clone(last), 0x00)
 			}
-
 		}
 	}
 }
@@ -0,0 +1,197 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/aep/kane/kv"
+)
+
+var indexVersionKey = []byte{'_', 0xff, 'i', 'd', 'x'}
+
+// initIndexVersion marks a database that has no index yet as being in the current IndexVersion,
+// so that it is not taken for one indexed before versioning existed once it has keys
+func (DB *DB) initIndexVersion(ctx context.Context) error {
+	_, err := DB.KV.Get(ctx, indexVersionKey)
+	if !errors.Is(err, kv.ErrNotFound) {
+		return err
+	}
+	for _, err := range DB.KV.IterKeys(ctx, []byte{'f', 0xff}, prefixEnd([]byte{'f', 0xff})) {
+		if err != nil {
+			return err
+		}
+		// indexed before versioning existed, which MigrateIndex takes care of
+		return nil
+	}
+	_, _, err = DB.KV.CAS(ctx, indexVersionKey, nil, []byte{IndexVersion})
+	return err
+}
+
+// IndexVersion returns the format of the index keys stored in the database.
+func (DB *DB) IndexVersion(ctx context.Context) (int, error) {
+	b, err := DB.KV.Get(ctx, indexVersionKey)
+	if err != nil && !errors.Is(err, kv.ErrNotFound) {
+		return 0, err
+	}
+	if err == nil && len(b) == 1 {
+		return int(b[0]), nil
+	}
+
+	// no marker: either nothing was ever indexed, or it was indexed before versioning existed
+	for _, err := range DB.KV.IterKeys(ctx, []byte{'f', 0xff}, prefixEnd([]byte{'f', 0xff})) {
+		if err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	return IndexVersion, nil
+}
+
+// MigrateIndex rewrites all index keys written by an older IndexVersion into the current format.
+// It can run while the database is in use and can be restarted if interrupted.
+// Until it is done, filters will not match documents that are still indexed in the old format.
+func (DB *DB) MigrateIndex(ctx context.Context) error {
+	version, err := DB.IndexVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version >= IndexVersion {
+		return nil
+	}
+
+	start := []byte{'f', 0xff}
+	end := prefixEnd(start)
+
+	for {
+		// collect a batch first instead of writing into the range that is being iterated
+		var batch [][]byte
+		for k, err := range DB.KV.IterKeys(ctx, start, end) {
+			if err != nil {
+				return err
+			}
+			batch = append(batch, k)
+			if len(batch) >= 1000 {
+				break
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, k := range batch {
+			err := DB.migrateIndexKey(ctx, k)
+			if err != nil {
+				return err
+			}
+		}
+
+		start = append(bytes.Clone(batch[len(batch)-1]), 0x00)
+	}
+
+	return DB.KV.Set(ctx, indexVersionKey, []byte{IndexVersion})
+}
+
+func (DB *DB) migrateIndexKey(ctx context.Context, k []byte) error {
+	// f 0xff model 0xff .field 0xff value 0xff id 0xff
+	if len(k) < 14 || k[len(k)-1] != 0xff || k[len(k)-10] != 0xff {
+		return nil
+	}
+	modelEnd := bytes.IndexByte(k[2:], 0xff)
+	if modelEnd < 0 {
+		return nil
+	}
+	modelEnd += 2
+	fieldEnd := bytes.IndexByte(k[modelEnd+1:], 0xff)
+	if fieldEnd < 0 {
+		return nil
+	}
+	fieldEnd += modelEnd + 1
+	if fieldEnd+1 >= len(k)-10 {
+		return nil
+	}
+
+	path := k[:fieldEnd]
+	field := string(k[modelEnd+1 : fieldEnd])
+	val := k[fieldEnd+1 : len(k)-10]
+	postfix := k[len(k)-10:]
+	id := k[len(k)-9 : len(k)-1]
+
+	var vals [][]byte
+	switch val[0] {
+	case ValueInteger:
+		if len(val) != 10 {
+			return nil
+		}
+		u := binary.BigEndian.Uint64(val[2:])
+		if val[1] == 1 {
+			vals = append(vals, uintVal(u))
+		} else {
+			vals = append(vals, intVal(int64(u)))
+		}
+	case ValueString:
+		vals = append(vals, escapeVal(ValueText, val[1:]))
+	case ValueBytes:
+		vals = append(vals, escapeVal(ValueBinary, val[1:]))
+	case ValueFloat:
+		// the fraction was lost in the old key, so it has to come from the document
+		opath := append([]byte{'o', 0xff}, id...)
+		opath = append(opath, 0xff)
+		b, err := DB.KV.Get(ctx, opath)
+		if err != nil && !errors.Is(err, kv.ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			var doc StoredDocument
+			if deserializeStore(b, &doc) == nil {
+				for _, n := range numbersAt(doc.Val, ".", field, nil) {
+					vbin, err := indexVal(n)
+					if err == nil {
+						vals = append(vals, vbin)
+					}
+				}
+			}
+		}
+	default:
+		return nil
+	}
+
+	for _, vbin := range vals {
+		pathW := append(bytes.Clone(path), 0xff)
+		pathW = append(pathW, vbin...)
+		pathW = append(pathW, postfix...)
+		err := DB.KV.Set(ctx, pathW, []byte{0xff})
+		if err != nil {
+			return err
+		}
+	}
+
+	return DB.KV.Del(ctx, k)
+}
+
+// numbersAt collects all numbers of a decoded document that indexI would index under field
+func numbersAt(obj any, path string, field string, r []json.Number) []json.Number {
+	switch v := obj.(type) {
+	case []interface{}:
+		for _, v := range v {
+			r = numbersAt(v, path, field, r)
+		}
+	case map[string]interface{}:
+		for k, v := range v {
+			path2 := path
+			if !strings.HasSuffix(path2, ".") {
+				path2 += "."
+			}
+			r = numbersAt(v, path2+k, field, r)
+		}
+	case json.Number:
+		if path == field {
+			r = append(r, v)
+		}
+	}
+	return r
+}
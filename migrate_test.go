@@ -0,0 +1,146 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type MigrateTestDoc struct {
+	ID    string
+	Count int
+	Score float64
+}
+
+func (d *MigrateTestDoc) PK() any {
+	return d.ID
+}
+
+func TestMigrateIndex(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "pebble-migrate-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, err := Init("pebble://" + filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("Failed to create PebbleDB: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	doc := &MigrateTestDoc{ID: "migrate-test-1", Count: -3, Score: 1.5}
+	err = db.Put(ctx, doc)
+	if err != nil {
+		t.Fatalf("Failed to put document: %v", err)
+	}
+
+	// replace the index with what an old version would have written, which had no version marker
+	db.KV.Del(ctx, indexVersionKey)
+	prefix := []byte("f\xffMigrateTestDoc\xff")
+	var id []byte
+	var keys [][]byte
+	for k, err := range db.KV.IterKeys(ctx, prefix, prefixEnd(prefix)) {
+		if err != nil {
+			t.Fatalf("Failed to iterate keys: %v", err)
+		}
+		keys = append(keys, k)
+		id = k[len(k)-9 : len(k)-1]
+	}
+	for _, k := range keys {
+		db.KV.Del(ctx, k)
+	}
+	for field, val := range map[string]any{"ID": doc.ID, "Count": doc.Count, "Score": doc.Score} {
+		vbin, err := indexValV1(val)
+		if err != nil {
+			t.Fatalf("indexValV1(%v): %v", val, err)
+		}
+		k := append(bytes.Clone(prefix), '.')
+		k = append(k, field...)
+		k = append(k, 0xff)
+		k = append(k, vbin...)
+		k = append(k, 0xff)
+		k = append(k, id...)
+		k = append(k, 0xff)
+		db.KV.Set(ctx, k, []byte{0xff})
+	}
+
+	version, err := db.IndexVersion(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get index version: %v", err)
+	}
+	if version != 1 {
+		t.Fatalf("Expected index version 1, got %d", version)
+	}
+
+	var r MigrateTestDoc
+	if db.Get(ctx, &r, Eq("Score", 1.5)) == nil {
+		t.Fatalf("Expected old index to not match")
+	}
+
+	err = db.MigrateIndex(ctx)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	for _, op := range []Filter{Eq("ID", doc.ID), Eq("Count", -3), Eq("Score", 1.5), Lt("Count", 0)} {
+		var r MigrateTestDoc
+		err := db.Get(ctx, &r, op)
+		if err != nil {
+			t.Fatalf("Failed to get migrated document: %v", err)
+		}
+		if r.ID != doc.ID {
+			t.Errorf("Got wrong document %s", r.ID)
+		}
+	}
+
+	version, err = db.IndexVersion(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get index version: %v", err)
+	}
+	if version != IndexVersion {
+		t.Errorf("Expected index version %d, got %d", IndexVersion, version)
+	}
+
+	// Put/Del must still find the same k key after migration
+	err = db.Del(ctx, doc)
+	if err != nil {
+		t.Fatalf("Failed to delete document: %v", err)
+	}
+	if db.Get(ctx, &r, Eq("ID", doc.ID)) == nil {
+		t.Errorf("Expected document to be deleted")
+	}
+}
+
+func TestIndexVersionFresh(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "pebble-migrate-fresh-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, err := Init("pebble://" + filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("Failed to create PebbleDB: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	err = db.Put(ctx, &MigrateTestDoc{ID: "migrate-fresh-1", Count: 1})
+	if err != nil {
+		t.Fatalf("Failed to put document: %v", err)
+	}
+
+	version, err := db.IndexVersion(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get index version: %v", err)
+	}
+	if version != IndexVersion {
+		t.Errorf("Expected a new database to stay at index version %d, got %d", IndexVersion, version)
+	}
+}
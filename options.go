@@ -0,0 +1,165 @@
+package kane
+
+import (
+	"reflect"
+	"time"
+)
+
+// Opt changes how Iter and Get run a query, for example OrderBy, or how a write is retried, see Retry
+type Opt any
+
+type Direction int
+
+const (
+	Asc Direction = iota
+	Desc
+)
+
+type orderBy struct {
+	key string
+	dir Direction
+}
+
+// OrderBy returns documents sorted by the value of key, read in order from its index.
+// documents without a value for key are not returned.
+// documents with multiple values for key, like arrays, are sorted by whichever comes first.
+// a filter on the same field only narrows the scan, and so does a CompoundIndex that is equal on the fields before key.
+// any other filter is run first and the ids of all documents matching it are held in memory
+// while walking the index of key, again for every page of a Cursor, so it should be selective.
+func OrderBy(key string, dir Direction) Opt {
+	return orderBy{key: key, dir: dir}
+}
+
+type limit int
+
+// Limit stops iteration after n documents
+func Limit(n int) Opt {
+	return limit(n)
+}
+
+type cursor struct {
+	c *string
+}
+
+// Cursor makes Iter continue after the document that c points to, if c is not empty,
+// and keeps c pointing at the last document returned.
+// c is set to "" once there are no more documents.
+// pass the same filter and options to continue a query with c.
+// c only holds the position of the last document, not which documents were returned before it,
+// so a document with several values in the scanned range, like an array field with Has, a range or OrderBy,
+// is returned once by each call of Iter, but can be returned again on a later page.
+// callers that cannot have duplicates across pages have to skip them by primary key.
+func Cursor(c *string) Opt {
+	return cursor{c: c}
+}
+
+type batchSize int
+
+// BatchSize sets how many documents Iter loads from the database at once.
+// the default is 100
+func BatchSize(n int) Opt {
+	return batchSize(n)
+}
+
+type lenient struct {
+	onSkip func(skipped int, err *ObjectError)
+}
+
+// Lenient makes Iter skip documents that cannot be loaded instead of returning an *ObjectError.
+// onSkip, if not nil, is called for every skipped document with the number skipped so far.
+// without it, a query fails on the first such document, which includes the keys of a crashed create, see ObjectError.
+func Lenient(onSkip func(skipped int, err *ObjectError)) Opt {
+	return lenient{onSkip: onSkip}
+}
+
+type retry struct {
+	p RetryPolicy
+}
+
+// Retry overrides DB.RetryPolicy for one call of Set, Swap, Del, Mutate or Patch
+func Retry(p RetryPolicy) Opt {
+	return retry{p: p}
+}
+
+type dryRun struct{}
+
+// DryRun makes GC only report what it would delete
+func DryRun() Opt {
+	return dryRun{}
+}
+
+type horizon time.Duration
+
+// Horizon makes GC only collect garbage older than d. the default is DefaultGCHorizon
+func Horizon(d time.Duration) Opt {
+	return horizon(d)
+}
+
+type models []any
+
+// Models makes Verify derive the index keys of the models of docs from their Go types,
+// instead of from the stored JSON, and makes GC collect stale index keys of their documents
+func Models(docs ...any) Opt {
+	return models(docs)
+}
+
+type repair struct{}
+
+// Repair makes Verify fix the index keys it finds to be wrong
+func Repair() Opt {
+	return repair{}
+}
+
+type queryOpts struct {
+	order     *orderBy
+	limit     int
+	cursor    *string
+	batchSize int
+	lenient   *lenient
+	retry     *RetryPolicy
+	dryRun    bool
+	horizon   *time.Duration
+	models    map[string]reflect.Type
+	repair    bool
+}
+
+func parseOpts(opts []Opt) queryOpts {
+	q := queryOpts{batchSize: 100}
+	for _, opt := range opts {
+		switch opt := opt.(type) {
+		case orderBy:
+			q.order = &opt
+		case limit:
+			q.limit = int(opt)
+		case cursor:
+			q.cursor = opt.c
+		case lenient:
+			q.lenient = &opt
+		case retry:
+			q.retry = &opt.p
+		case dryRun:
+			q.dryRun = true
+		case horizon:
+			d := time.Duration(opt)
+			q.horizon = &d
+		case models:
+			if q.models == nil {
+				q.models = map[string]reflect.Type{}
+			}
+			for _, doc := range opt {
+				t := reflect.TypeOf(doc)
+				for t.Kind() == reflect.Ptr {
+					t = t.Elem()
+				}
+				q.models[getModelFromAny(doc)] = t
+			}
+		case repair:
+			q.repair = true
+		case batchSize:
+			if opt > 0 {
+				q.batchSize = int(opt)
+			}
+		}
+	}
+	return q
+}
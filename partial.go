@@ -0,0 +1,46 @@
+package kane
+
+// PartialIndex indexes the values of Fields together, like a CompoundIndex, but only of documents matching Where,
+// so that a query for a small part of a large model only scans that part, see ModelSchema.
+// it is stored as a field called Name, and can be queried by that name, or is used for queries that have all of the filters of Where,
+// if Where is a single filter or an And of single filters.
+// without Fields, it only indexes which documents match Where.
+// the fields of Where have to be indexed, since it is matched against the index keys of the document.
+type PartialIndex struct {
+	Name   string
+	Fields []string
+	Where  Filter
+}
+
+// whereLeaves returns the single filters of where, if it is one or an And of them
+func whereLeaves(where Filter) ([]Filter, bool) {
+	if where.err != nil {
+		return nil, false
+	}
+	if where.op == filterScan {
+		return []Filter{where}, true
+	}
+	if where.op != filterAnd {
+		return nil, false
+	}
+	for _, sub := range where.sub {
+		if sub.err != nil || sub.op != filterScan {
+			return nil, false
+		}
+	}
+	return where.sub, true
+}
+
+// partialKeys returns the index keys of the partial indexes that doc, with the index keys keys, belongs to
+func partialKeys(doc *StoredDocument, partial []PartialIndex, keys [][]byte, model []byte, path []byte, postfix []byte) [][]byte {
+	prefix := indexPrefix(string(model))
+
+	var pkeys [][]byte
+	for _, p := range partial {
+		if p.Where.err != nil || !p.Where.matches(prefix, keys) {
+			continue
+		}
+		pkeys = append(pkeys, multiKeys(doc, p.Name, p.Fields, path, postfix)...)
+	}
+	return pkeys
+}
@@ -0,0 +1,223 @@
+package kane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type PartialTestDoc struct {
+	ID     string
+	UserID string
+	Order  int
+	Done   bool
+}
+
+func (d *PartialTestDoc) PK() any {
+	return d.ID
+}
+
+func (d *PartialTestDoc) Schema() ModelSchema {
+	return ModelSchema{
+		Partial: []PartialIndex{
+			{Name: "open", Fields: []string{"UserID", "Order"}, Where: Eq("Done", false)},
+		},
+	}
+}
+
+func TestPartial(t *testing.T) {
+	schema, _ := schemaOf(docType(PartialTestDoc{}))
+	indexes := multiIndexes(schema)
+
+	t.Run("Plan", func(t *testing.T) {
+		op := planCompound(indexes, And(Eq("UserID", "bob"), Eq("Done", false)))
+		if len(op.sub) != 1 || op.sub[0].key != "open" {
+			t.Errorf("Expected a scan of open, got %+v", op)
+		}
+
+		// a scan of open by UserID and Order is not sorted by id like the one of Done
+		op = planCompound(indexes, Eq("Done", false))
+		if op.op != filterScan || op.key != "Done" {
+			t.Errorf("Expected a scan of Done, got %+v", op)
+		}
+
+		closed := multiIndexes(ModelSchema{Partial: []PartialIndex{{Name: "closed", Where: Eq("Done", true)}}})
+		op = planCompound(closed, Eq("Done", true))
+		if op.op != filterScan || op.key != "closed" || !op.exact {
+			t.Errorf("Expected an exact scan of closed, got %+v", op)
+		}
+
+		// done todos are not in the index
+		op = planCompound(indexes, And(Eq("UserID", "bob"), Eq("Done", true)))
+		if len(op.sub) != 2 || op.sub[0].key != "UserID" {
+			t.Errorf("Expected no partial scan, got %+v", op)
+		}
+	})
+
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		var docs []*PartialTestDoc
+		for i, user := range []string{"alice", "bob", "bob", "bob", "carol", "bob"} {
+			doc := &PartialTestDoc{
+				ID:     fmt.Sprintf("partial-test-%d", i),
+				UserID: user,
+				Order:  (i * 7) % 5,
+				Done:   i%2 == 0,
+			}
+			if err := db.Put(ctx, doc); err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			docs = append(docs, doc)
+		}
+
+		// bob has open 1:2 3:1 5:0 and done 2:4
+		ids := func(t *testing.T, op Filter, opts ...Opt) []string {
+			var ids []string
+			for doc, err := range Iter[PartialTestDoc](ctx, db, op, opts...) {
+				if err != nil {
+					t.Fatalf("Failed to iterate: %v", err)
+				}
+				ids = append(ids, doc.ID)
+			}
+			return ids
+		}
+
+		t.Run("Build", func(t *testing.T) {
+			// as if the documents were written before the index was declared
+			prefix := []byte("f\xffPartialTestDoc\xff.open\xff")
+			var keys [][]byte
+			for k, err := range db.KV.IterKeys(ctx, prefix, prefixEnd(prefix)) {
+				if err != nil {
+					t.Fatalf("Failed to iterate keys: %v", err)
+				}
+				keys = append(keys, k)
+			}
+			db.delKeys(ctx, keys)
+			db.KV.Del(ctx, builtPath("PartialTestDoc", "open"))
+			db.built.Delete("PartialTestDoc\xffopen")
+
+			if _, err := db.Count(ctx, PartialTestDoc{}, Has("open")); !errors.Is(err, ErrNotIndexed) {
+				t.Errorf("Expected ErrNotIndexed before the build, got %v", err)
+			}
+			got := ids(t, And(Eq("UserID", "bob"), Eq("Done", false)))
+			if len(got) != 3 {
+				t.Errorf("Expected bob's open todos without the index, got %v", got)
+			}
+
+			if err := db.BuildIndexes(ctx, PartialTestDoc{}); err != nil {
+				t.Fatalf("Failed to build indexes: %v", err)
+			}
+			n, err := db.Count(ctx, PartialTestDoc{}, Has("open"))
+			if err != nil || n != 3 {
+				t.Errorf("Expected 3 open todos after the build, got %d %v", n, err)
+			}
+		})
+
+		t.Run("Keys", func(t *testing.T) {
+			for _, doc := range docs[1:3] {
+				keys, err := db.indexKeys(&StoredDocument{Val: doc}, []byte("PartialTestDoc"), []byte("12345678"))
+				if err != nil {
+					t.Fatalf("Failed to get index keys: %v", err)
+				}
+				has := slices.ContainsFunc(keys, func(k []byte) bool {
+					return string(k[:len("f\xffPartialTestDoc\xff.open\xff")]) == "f\xffPartialTestDoc\xff.open\xff"
+				})
+				if has == doc.Done {
+					t.Errorf("Expected open key only for open todos, got %v for done %v", has, doc.Done)
+				}
+			}
+		})
+
+		t.Run("Query", func(t *testing.T) {
+			got := ids(t, And(Eq("UserID", "bob"), Eq("Done", false)))
+			slices.Sort(got)
+			if !slices.Equal(got, []string{"partial-test-1", "partial-test-3", "partial-test-5"}) {
+				t.Errorf("Expected bob's open todos, got %v", got)
+			}
+
+			got = ids(t, And(Eq("UserID", "bob"), Eq("Done", false)), OrderBy("Order", Asc))
+			if !slices.Equal(got, []string{"partial-test-5", "partial-test-3", "partial-test-1"}) {
+				t.Errorf("Expected bob's open todos by order, got %v", got)
+			}
+
+			n, err := db.Count(ctx, PartialTestDoc{}, Has("open"))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if n != 3 {
+				t.Errorf("Expected 3 open todos, got %d", n)
+			}
+
+			got = ids(t, Eq("Done", false))
+			if len(got) != 3 {
+				t.Errorf("Expected 3 open todos, got %v", got)
+			}
+		})
+
+		t.Run("Update", func(t *testing.T) {
+			docs[3].Done = true
+			if err := db.Set(ctx, docs[3]); err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+			docs[2].Done = false
+			if err := db.Set(ctx, docs[2]); err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+
+			got := ids(t, And(Eq("UserID", "bob"), Eq("Done", false)), OrderBy("Order", Asc))
+			if !slices.Equal(got, []string{"partial-test-5", "partial-test-1", "partial-test-2"}) {
+				t.Errorf("Expected closed todo gone and reopened todo back, got %v", got)
+			}
+
+			if err := db.Del(ctx, docs[5]); err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+			n, err := db.Count(ctx, PartialTestDoc{}, Has("open"))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if n != 2 {
+				t.Errorf("Expected 2 open todos after delete, got %d", n)
+			}
+		})
+
+		for _, doc := range docs {
+			db.Del(ctx, doc)
+		}
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-partial-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
@@ -0,0 +1,426 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch changes the document with primary key pk and loads the result into doc.
+// patch is an RFC 7396 JSON merge patch, or an RFC 6902 JSON patch if it is a JSON array.
+// it is applied under the same version check as Update and retried according to the RetryPolicy of opts
+// if another write got in between.
+// nothing is written if the patch does not change the document.
+func (DB *DB) Patch(ctx context.Context, doc any, pk any, patch []byte, opts ...Opt) error {
+	model := getModelFromAny(doc)
+
+	var p any
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.UseNumber()
+	err := dec.Decode(&p)
+	if err != nil {
+		return fmt.Errorf("invalid patch: %w", err)
+	}
+	ops, isJSONPatch := p.([]any)
+
+	sdoc, ok := doc.(*StoredDocument)
+	if !ok {
+		sdoc = &StoredDocument{Val: doc}
+	}
+
+	policy := DB.retryPolicy(opts)
+
+	for n := 1; ; n++ {
+		ots, err := DB.getPointer(ctx, model, pk)
+		if err != nil {
+			return docError(err, model, pk)
+		}
+
+		var val any
+		current := &StoredDocument{Val: &val}
+		err = DB.getObject(ctx, current, ots)
+		if err != nil {
+			return docError(err, model, pk)
+		}
+
+		before, err := roundTrip(val, sdoc.Val)
+		if err != nil {
+			return docError(err, model, pk)
+		}
+		pkBefore, err := getPKFromAny(sdoc)
+		if err != nil {
+			return err
+		}
+
+		if isJSONPatch {
+			val, err = jsonPatch(val, ops)
+		} else {
+			val = mergePatch(val, p)
+		}
+		if err != nil {
+			return docError(err, model, pk)
+		}
+
+		after, err := roundTrip(val, sdoc.Val)
+		if err != nil {
+			return docError(err, model, pk)
+		}
+		pkAfter, err := getPKFromAny(sdoc)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(pkBefore, pkAfter) {
+			return docError(fmt.Errorf("%w: Patch cannot change the primary key", ErrInvalidKey), model, pk)
+		}
+
+		if bytes.Equal(before, after) {
+			sdoc.History = current.History
+			sdoc.Version = current.Version
+			return nil
+		}
+
+		err = DB.Update(ctx, sdoc, current.Version)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+
+		again, rerr := DB.retry(ctx, policy, n)
+		if rerr != nil {
+			return rerr
+		}
+		if !again {
+			return err
+		}
+	}
+}
+
+// roundTrip decodes the generic json value val into the go value pointed to by into,
+// and returns its json encoding, which is the same for values that would be stored the same
+func roundTrip(val any, into any) ([]byte, error) {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+
+	v := reflect.ValueOf(into)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, fmt.Errorf("%T is not a pointer", into)
+	}
+	v.Elem().Set(reflect.Zero(v.Elem().Type()))
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = dec.Decode(into)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(into)
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch to target
+func mergePatch(target any, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// jsonPatch applies the operations of an RFC 6902 JSON patch to doc
+func jsonPatch(doc any, ops []any) (any, error) {
+	for i, op := range ops {
+		o, ok := op.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid patch operation %d", i)
+		}
+
+		name, _ := o["op"].(string)
+		path, err := jsonPointer(o["path"])
+		if err != nil {
+			return nil, fmt.Errorf("patch operation %d: %w", i, err)
+		}
+
+		switch name {
+		case "add":
+			value, ok := o["value"]
+			if !ok {
+				return nil, fmt.Errorf("patch operation %d: missing value", i)
+			}
+			doc, err = jsonAdd(doc, path, jsonCopy(value))
+		case "remove":
+			doc, _, err = jsonRemove(doc, path)
+		case "replace":
+			value, ok := o["value"]
+			if !ok {
+				return nil, fmt.Errorf("patch operation %d: missing value", i)
+			}
+			if len(path) > 0 {
+				doc, _, err = jsonRemove(doc, path)
+			}
+			if err == nil {
+				doc, err = jsonAdd(doc, path, jsonCopy(value))
+			}
+		case "move", "copy":
+			var from []string
+			from, err = jsonPointer(o["from"])
+			if err != nil {
+				break
+			}
+			var value any
+			if name == "move" {
+				if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+					err = fmt.Errorf("cannot move %v into itself", o["from"])
+					break
+				}
+				doc, value, err = jsonRemove(doc, from)
+			} else {
+				value, err = jsonGet(doc, from)
+				value = jsonCopy(value)
+			}
+			if err == nil {
+				doc, err = jsonAdd(doc, path, value)
+			}
+		case "test":
+			var value any
+			value, err = jsonGet(doc, path)
+			if err == nil && !jsonEqual(value, o["value"]) {
+				err = fmt.Errorf("test failed at %v", o["path"])
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", name)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("patch operation %d: %w", i, err)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointer parses an RFC 6901 JSON pointer
+func jsonPointer(p any) ([]string, error) {
+	s, ok := p.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid path %v", p)
+	}
+	if s == "" {
+		return []string{}, nil
+	}
+	if s[0] != '/' {
+		return nil, fmt.Errorf("invalid path %q", s)
+	}
+
+	parts := strings.Split(s[1:], "/")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+	}
+	return parts, nil
+}
+
+func jsonIndex(key string, n int, allowEnd bool) (int, error) {
+	if allowEnd && key == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || i > n || (i == n && !allowEnd) || (len(key) > 1 && key[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", key)
+	}
+	return i, nil
+}
+
+func jsonGet(node any, path []string) (any, error) {
+	for _, key := range path {
+		switch n := node.(type) {
+		case map[string]any:
+			v, ok := n[key]
+			if !ok {
+				return nil, fmt.Errorf("%q not found", key)
+			}
+			node = v
+		case []any:
+			i, err := jsonIndex(key, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("%q not found", key)
+		}
+	}
+	return node, nil
+}
+
+// jsonAdd returns node with val added at path
+func jsonAdd(node any, path []string, val any) (any, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+	key := path[0]
+
+	switch n := node.(type) {
+	case map[string]any:
+		if len(path) == 1 {
+			n[key] = val
+			return n, nil
+		}
+		child, ok := n[key]
+		if !ok {
+			return nil, fmt.Errorf("%q not found", key)
+		}
+		child, err := jsonAdd(child, path[1:], val)
+		if err != nil {
+			return nil, err
+		}
+		n[key] = child
+		return n, nil
+
+	case []any:
+		if len(path) == 1 {
+			i, err := jsonIndex(key, len(n), true)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = val
+			return n, nil
+		}
+		i, err := jsonIndex(key, len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := jsonAdd(n[i], path[1:], val)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = child
+		return n, nil
+	}
+
+	return nil, fmt.Errorf("%q not found", key)
+}
+
+// jsonRemove returns node without the value at path, and the removed value
+func jsonRemove(node any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+	key := path[0]
+
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := n[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("%q not found", key)
+		}
+		if len(path) == 1 {
+			delete(n, key)
+			return n, child, nil
+		}
+		child, removed, err := jsonRemove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[key] = child
+		return n, removed, nil
+
+	case []any:
+		i, err := jsonIndex(key, len(n), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := n[i]
+			return append(n[:i], n[i+1:]...), removed, nil
+		}
+		child, removed, err := jsonRemove(n[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[i] = child
+		return n, removed, nil
+	}
+
+	return nil, nil, fmt.Errorf("%q not found", key)
+}
+
+func jsonCopy(node any) any {
+	switch n := node.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(n))
+		for k, v := range n {
+			c[k] = jsonCopy(v)
+		}
+		return c
+	case []any:
+		c := make([]any, len(n))
+		for i, v := range n {
+			c[i] = jsonCopy(v)
+		}
+		return c
+	}
+	return node
+}
+
+// jsonEqual compares generic json values, where numbers are equal if their values are
+func jsonEqual(a any, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			bv, ok := b[k]
+			if !ok || !jsonEqual(v, bv) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		av, err := indexVal(a)
+		if err != nil {
+			return a == b
+		}
+		bv, err := indexVal(b)
+		if err != nil {
+			return false
+		}
+		return bytes.Equal(av, bv)
+	}
+	return a == b
+}
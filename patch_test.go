@@ -0,0 +1,223 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, s string) any {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("invalid json %s: %v", s, err)
+	}
+	return v
+}
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396 appendix A
+	cases := []struct{ target, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, c := range cases {
+		got := mergePatch(decodeJSON(t, c.target), decodeJSON(t, c.patch))
+		if !jsonEqual(got, decodeJSON(t, c.result)) {
+			t.Errorf("merge %s into %s: got %v, want %s", c.patch, c.target, got, c.result)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	// examples from RFC 6902 appendix A, an empty result means the patch must fail
+	cases := []struct{ doc, patch, result string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"foo":"bar"}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"foo":"bar","baz":"bar"}`},
+		{`{"foo":{"a":1}}`, `[{"op":"move","from":"/foo","path":"/foo/b"}]`, ``},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+		{`{"foo":"bar"}`, `[{"op":"frobnicate","path":"/foo"}]`, ``},
+	}
+
+	for _, c := range cases {
+		got, err := jsonPatch(decodeJSON(t, c.doc), decodeJSON(t, c.patch).([]any))
+		if c.result == "" {
+			if err == nil {
+				t.Errorf("patch %s on %s: expected error, got %v", c.patch, c.doc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("patch %s on %s: %v", c.patch, c.doc, err)
+			continue
+		}
+		if !jsonEqual(got, decodeJSON(t, c.result)) {
+			t.Errorf("patch %s on %s: got %v, want %s", c.patch, c.doc, got, c.result)
+		}
+	}
+}
+
+type PatchTestDoc struct {
+	ID    string
+	Name  string
+	Age   int
+	Tags  []any
+	Extra map[string]any `json:",omitempty"`
+}
+
+func (d *PatchTestDoc) PK() any {
+	return d.ID
+}
+
+func TestPatch(t *testing.T) {
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		doc := &PatchTestDoc{ID: "patch-test-1", Name: "Alice", Age: 30, Tags: []any{"a"}}
+		err := db.Put(ctx, doc)
+		if err != nil {
+			t.Fatalf("Failed to put document: %v", err)
+		}
+
+		t.Run("MergePatch", func(t *testing.T) {
+			var got PatchTestDoc
+			err := db.Patch(ctx, &got, "patch-test-1", []byte(`{"Age":31,"Extra":{"x":1}}`))
+			if err != nil {
+				t.Fatalf("Failed to patch document: %v", err)
+			}
+			if got.Name != "Alice" || got.Age != 31 || got.Extra["x"] == nil {
+				t.Errorf("Patched document has wrong data: %+v", got)
+			}
+
+			expect := func(op Filter, want int) {
+				n, err := db.Count(ctx, PatchTestDoc{}, op)
+				if err != nil {
+					t.Fatalf("Failed to count: %v", err)
+				}
+				if n != want {
+					t.Errorf("Expected %d documents, got %d", want, n)
+				}
+			}
+			expect(Eq("Age", 31), 1)
+			expect(Eq("Age", 30), 0)
+			expect(Eq("Name", "Alice"), 1)
+		})
+
+		t.Run("JSONPatch", func(t *testing.T) {
+			var got PatchTestDoc
+			err := db.Patch(ctx, &got, "patch-test-1", []byte(`[{"op":"add","path":"/Tags/-","value":"b"},{"op":"remove","path":"/Extra"}]`))
+			if err != nil {
+				t.Fatalf("Failed to patch document: %v", err)
+			}
+			if len(got.Tags) != 2 || got.Tags[1] != "b" || got.Extra != nil {
+				t.Errorf("Patched document has wrong data: %+v", got)
+			}
+
+			err = db.Patch(ctx, &got, "patch-test-1", []byte(`[{"op":"test","path":"/Age","value":99},{"op":"replace","path":"/Age","value":1}]`))
+			if err == nil {
+				t.Error("Expected failed test to abort the patch")
+			}
+		})
+
+		t.Run("NoChange", func(t *testing.T) {
+			before := &StoredDocument{Val: &PatchTestDoc{}}
+			err := db.GetByPK(ctx, before, "patch-test-1")
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+
+			after := &StoredDocument{Val: &PatchTestDoc{}}
+			err = db.Patch(ctx, after, "patch-test-1", []byte(`{"Name":"Alice","Age":31}`))
+			if err != nil {
+				t.Fatalf("Failed to patch document: %v", err)
+			}
+			if after.Version != before.Version {
+				t.Errorf("Expected no write for a patch without changes, version went from %d to %d", before.Version, after.Version)
+			}
+		})
+
+		t.Run("Invalid", func(t *testing.T) {
+			var got PatchTestDoc
+			err := db.Patch(ctx, &got, "patch-test-1", []byte(`{"ID":"patch-test-2"}`))
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Expected ErrInvalidKey when changing the primary key, got %v", err)
+			}
+
+			err = db.Patch(ctx, &got, "patch-test-1", []byte(`{"Age":"old"}`))
+			if err == nil {
+				t.Error("Expected error for a patch that does not fit the type")
+			}
+
+			err = db.Patch(ctx, &got, "patch-test-missing", []byte(`{"Age":1}`))
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for missing document, got %v", err)
+			}
+		})
+
+		err = db.Del(ctx, doc)
+		if err != nil {
+			t.Fatalf("Failed to delete document: %v", err)
+		}
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-patch-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
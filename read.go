@@ -2,6 +2,8 @@ package kane
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
@@ -9,24 +11,111 @@ import (
 	"github.com/aep/kane/kv"
 )
 
-func (DB *DB) Get(ctx context.Context, doc any, op Filter) error {
+func (DB *DB) Get(ctx context.Context, doc any, op Filter, opts ...Opt) error {
 	lifetime := &kv.Lifetime{}
 	defer lifetime.Close()
 
 	model := getModelFromAny(doc)
 
-	var ots []byte
-	for k, err := range DB.find(ctx, model, op) {
+	sdoc, ok := doc.(*StoredDocument)
+	if !ok {
+		sdoc = &StoredDocument{Val: doc}
+	}
+
+	stale := false
+	for h, err := range DB.find(ctx, model, docType(doc), op, parseOpts(opts), nil) {
 		if err != nil {
 			return err
 		}
-		ots = k
-		break
+
+		// do not leave fields of a stale version behind
+		if stale {
+			resetValue(sdoc.Val)
+		}
+
+		err = DB.getObject(ctx, sdoc, h.id)
+		if errors.Is(err, ErrNotFound) {
+			// deleted since it was found
+			continue
+		}
+		if err != nil {
+			return docError(err, model, nil)
+		}
+
+		current, err := DB.verify(ctx, model, op, []hit{h}, []*StoredDocument{sdoc})
+		if err != nil {
+			return docError(err, model, nil)
+		}
+		if current[0] {
+			return nil
+		}
+		stale = true
 	}
-	if ots == nil {
-		return fmt.Errorf("not found")
+
+	if stale {
+		resetValue(sdoc.Val)
 	}
+	return docError(ErrNotFound, model, nil)
+}
+
+// resetValue sets the value that val points to to its zero value
+func resetValue(val any) {
+	v := reflect.ValueOf(val)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v.Elem().SetZero()
+	}
+}
+
+// GetByPK loads the current document with primary key pk into doc.
+// unlike Get with a filter it reads the primary key pointer directly,
+// so it works for computed primary keys that are not a field of the document.
+func (DB *DB) GetByPK(ctx context.Context, doc any, pk any) error {
+	model := getModelFromAny(doc)
+
+	ots, err := DB.getPointer(ctx, model, pk)
+	if err != nil {
+		return docError(err, model, pk)
+	}
+
+	err = DB.getObject(ctx, doc, ots)
+	if err != nil {
+		return docError(err, model, pk)
+	}
+	return nil
+}
 
+// GetPK returns the current document of type Val with primary key pk
+func GetPK[Val any](ctx context.Context, DB *DB, pk any) (Val, error) {
+	var val Val
+	err := DB.GetByPK(ctx, &val, pk)
+	return val, err
+}
+
+// getPointer returns the id of the object with primary key pk
+func (DB *DB) getPointer(ctx context.Context, model string, pk any) ([]byte, error) {
+	// k keys are never migrated, see indexValV1
+	pkb, err := indexValV1(pk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	pkpath := append([]byte{'k', 0xff}, model...)
+	pkpath = append(pkpath, 0xff)
+	pkpath = append(pkpath, pkb...)
+	pkpath = append(pkpath, 0xff)
+
+	ots, err := DB.KV.Get(ctx, pkpath)
+	if err != nil {
+		return nil, err
+	}
+	// a pointer locked by a write in progress still starts with the object id
+	if len(ots) != 8 && len(ots) != 16 {
+		return nil, ErrNotFound
+	}
+	return ots[:8], nil
+}
+
+func (DB *DB) getObject(ctx context.Context, doc any, ots []byte) error {
 	path := append([]byte{'o', 0xff}, ots...)
 	path = append(path, 0xff)
 
@@ -39,9 +128,43 @@ func (DB *DB) Get(ctx context.Context, doc any, op Filter) error {
 		doc = &StoredDocument{Val: doc}
 	}
 
-	err = deserializeStore(b, &doc)
+	sdoc := doc.(*StoredDocument)
+	sdoc.Version = 0
+	err = deserializeStore(b, sdoc)
 	if err != nil {
 		return err
 	}
+	if sdoc.Version == 0 {
+		sdoc.Version = binary.LittleEndian.Uint64(ots)
+	}
 	return nil
 }
+
+// Count returns the number of documents of the same model as doc that match op.
+// it only reads the index, never the documents themselves.
+func (DB *DB) Count(ctx context.Context, doc any, op Filter) (int, error) {
+	model := getModelFromAny(doc)
+
+	n := 0
+	for _, err := range DB.find(ctx, model, docType(doc), op, queryOpts{}, nil) {
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Exists returns true if any document of the same model as doc matches op.
+// it only reads the index, never the documents themselves.
+func (DB *DB) Exists(ctx context.Context, doc any, op Filter) (bool, error) {
+	model := getModelFromAny(doc)
+
+	for _, err := range DB.find(ctx, model, docType(doc), op, queryOpts{}, nil) {
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
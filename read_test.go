@@ -2,8 +2,11 @@ package kane
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -16,6 +19,16 @@ func (t *TestDoc) PK() any {
 	return t.ID
 }
 
+type ComputedPKDoc struct {
+	Owner string
+	Order int
+	Name  string
+}
+
+func (t *ComputedPKDoc) PK() any {
+	return fmt.Sprintf("%s/%d", t.Owner, t.Order)
+}
+
 func TestReadOperations(t *testing.T) {
 	runTests := func(t *testing.T, db *DB) {
 		ctx := context.Background()
@@ -43,8 +56,48 @@ func TestReadOperations(t *testing.T) {
 			// Test not found case
 			notFoundDoc := &TestDoc{ID: "does-not-exist"}
 			err = db.Get(ctx, notFoundDoc, Eq("ID", "does-not-exist"))
-			if err == nil {
-				t.Error("Expected error for non-existent document, got nil")
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for non-existent document, got %v", err)
+			}
+
+			// Clean up
+			err = db.Del(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to delete test document: %v", err)
+			}
+		})
+
+		t.Run("GetByPK", func(t *testing.T) {
+			doc := &ComputedPKDoc{Owner: "bob", Order: 3, Name: "Computed"}
+			err := db.Put(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to create test document: %v", err)
+			}
+
+			retrievedDoc := &ComputedPKDoc{}
+			err = db.GetByPK(ctx, retrievedDoc, "bob/3")
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if retrievedDoc.Name != "Computed" {
+				t.Errorf("Retrieved document has wrong data: got %q, want %q", retrievedDoc.Name, "Computed")
+			}
+
+			typed, err := GetPK[ComputedPKDoc](ctx, db, "bob/3")
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if typed.Owner != "bob" || typed.Order != 3 {
+				t.Errorf("Retrieved document has wrong data: got %+v", typed)
+			}
+
+			// Test not found case
+			_, err = GetPK[ComputedPKDoc](ctx, db, "bob/4")
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for non-existent document, got %v", err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "ComputedPKDoc bob/4") {
+				t.Errorf("Expected error to name the model and primary key, got %v", err)
 			}
 
 			// Clean up
@@ -52,6 +105,11 @@ func TestReadOperations(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Failed to delete test document: %v", err)
 			}
+
+			err = db.GetByPK(ctx, retrievedDoc, "bob/3")
+			if err == nil {
+				t.Error("Expected error for deleted document, got nil")
+			}
 		})
 	}
 
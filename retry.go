@@ -0,0 +1,121 @@
+package kane
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy controls how Set, Swap, Del, Mutate and Patch retry
+// when they lose against a concurrent write of the same primary key.
+// set it for all writes with DB.RetryPolicy, or for one call with the Retry option.
+// fields left at zero, other than MaxAttempts, are taken from DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is how often a write is attempted before it fails with ErrConflict.
+	// 0 retries until the context is done
+	MaxAttempts int
+
+	// BaseDelay is the wait before the first retry. it doubles for every further retry up to MaxDelay,
+	// or stays the same if MaxDelay is not larger
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Jitter is the fraction of the delay that is randomized, from 0 to 1.
+	// with 1, the wait is anywhere between half and one and a half times the delay.
+	// a negative Jitter turns it off
+	Jitter float64
+}
+
+// DefaultRetryPolicy is used if neither DB.RetryPolicy nor the Retry option is set
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay: 5 * time.Millisecond,
+	MaxDelay:  500 * time.Millisecond,
+	Jitter:    1,
+}
+
+// withDefaults fills the fields of p that are not set from DefaultRetryPolicy,
+// so that a policy that only sets MaxAttempts does not retry without waiting
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	if p.Jitter == 0 {
+		p.Jitter = DefaultRetryPolicy.Jitter
+	}
+	return p
+}
+
+// delay returns how long to wait before retry n, starting at 1
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < n && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = max(p.MaxDelay, p.BaseDelay)
+	}
+
+	j := time.Duration(float64(d) * min(max(p.Jitter, 0), 1))
+	if j > 0 {
+		d = d - j/2 + rand.N(j)
+	}
+	return d
+}
+
+// Stats counts how often writes ran into concurrent writes of the same primary key, see DB.Stats
+type Stats struct {
+	// Conflicts is the number of write attempts that lost against another write
+	Conflicts uint64
+	// Retries is the number of write attempts that were repeated after a conflict
+	Retries uint64
+	// GaveUp is the number of writes that failed with ErrConflict after RetryPolicy.MaxAttempts
+	GaveUp uint64
+}
+
+type stats struct {
+	conflicts atomic.Uint64
+	retries   atomic.Uint64
+	gaveUp    atomic.Uint64
+}
+
+// Stats returns the conflict and retry counts of all writes since the DB was opened
+func (DB *DB) Stats() Stats {
+	return Stats{
+		Conflicts: DB.stats.conflicts.Load(),
+		Retries:   DB.stats.retries.Load(),
+		GaveUp:    DB.stats.gaveUp.Load(),
+	}
+}
+
+// retryPolicy returns the policy for a write called with opts
+func (DB *DB) retryPolicy(opts []Opt) RetryPolicy {
+	p := DefaultRetryPolicy
+	if DB.RetryPolicy != nil {
+		p = *DB.RetryPolicy
+	}
+	if q := parseOpts(opts); q.retry != nil {
+		p = *q.retry
+	}
+	return p.withDefaults()
+}
+
+// retry waits before attempt n+1 of a write that just had its nth attempt fail with a conflict.
+// it returns false if the write should give up instead.
+func (DB *DB) retry(ctx context.Context, p RetryPolicy, n int) (bool, error) {
+	if p.MaxAttempts > 0 && n >= p.MaxAttempts {
+		DB.stats.gaveUp.Add(1)
+		return false, nil
+	}
+	DB.stats.retries.Add(1)
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(p.delay(n)):
+	}
+	return true, nil
+}
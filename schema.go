@@ -0,0 +1,234 @@
+package kane
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Schema can be implemented by a document to configure the index of its model.
+// it is called on the zero value of the document.
+type Schema interface {
+	Schema() ModelSchema
+}
+
+// ModelSchema configures the index of a model, see Schema.
+// compound, partial and func indexes added to a model that already has documents are only used
+// once BuildIndexes added them to those documents.
+// partial and func indexes are queried by their name like a field, so a schema where that is the name
+// of a field or of another index is rejected with ErrInvalidKey.
+type ModelSchema struct {
+	// NoIndex makes fields without a kane:"index" tag not indexed, instead of all of them.
+	// fields of nested structs are still indexed if they have the tag
+	NoIndex bool
+
+	// Compound are indexes on several fields together, see CompoundIndex
+	Compound []CompoundIndex
+
+	// Partial are indexes of only the documents matching a filter, see PartialIndex
+	Partial []PartialIndex
+
+	// Funcs are indexes of values derived from the documents, see IndexFunc
+	Funcs []FuncIndex
+}
+
+// docType returns the struct type of doc, or nil if it is not a struct
+func docType(doc any) reflect.Type {
+	if sdoc, ok := doc.(StoredDocument); ok {
+		doc = sdoc.Val
+	}
+	if sdoc, ok := doc.(*StoredDocument); ok {
+		doc = sdoc.Val
+	}
+
+	t := reflect.TypeOf(doc)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+// schemaOf returns the schema of the documents of type t
+func schemaOf(t reflect.Type) (ModelSchema, error) {
+	if t == nil {
+		return ModelSchema{}, nil
+	}
+	s, ok := reflect.New(t).Interface().(Schema)
+	if !ok {
+		return ModelSchema{}, nil
+	}
+	schema := s.Schema()
+	return schema, validateSchema(t, schema)
+}
+
+// validateSchema rejects partial and func indexes of documents of type t with names that cannot be told apart
+// from a field, or another index, since they are stored and queried like fields
+func validateSchema(t reflect.Type, schema ModelSchema) error {
+	names := map[string]bool{}
+	for i := 0; t.Kind() == reflect.Struct && i < t.NumField(); i++ {
+		if name, ok := jsonFieldName(t.Field(i)); ok {
+			names[name] = true
+		}
+	}
+	for _, c := range schema.Compound {
+		names[c.key()] = true
+	}
+
+	check := func(name string) error {
+		if name == "" || strings.IndexByte(name, 0xff) >= 0 {
+			return fmt.Errorf("%w: %s has an index named %q", ErrInvalidKey, t.Name(), name)
+		}
+		first, _, _ := strings.Cut(name, ".")
+		if names[name] || names[first] {
+			return fmt.Errorf("%w: %s has an index named %q like a field or another index", ErrInvalidKey, t.Name(), name)
+		}
+		names[name] = true
+		return nil
+	}
+	for _, p := range schema.Partial {
+		err := check(p.Name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range schema.Funcs {
+		err := check(f.name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexNames returns the names the compound, partial and func indexes of schema are stored as
+func indexNames(schema ModelSchema) []string {
+	var names []string
+	for _, c := range schema.Compound {
+		names = append(names, c.key())
+	}
+	for _, p := range schema.Partial {
+		names = append(names, p.Name)
+	}
+	for _, f := range schema.Funcs {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+// fieldTag is the kane struct tag of a field
+type fieldTag struct {
+	index   bool
+	noindex bool
+	// unique fields are indexed too
+	unique bool
+}
+
+func parseFieldTag(field reflect.StructField) fieldTag {
+	var tag fieldTag
+	for _, opt := range strings.Split(field.Tag.Get("kane"), ",") {
+		switch opt {
+		case "index":
+			tag.index = true
+		case "noindex":
+			tag.noindex = true
+		case "unique":
+			tag.unique = true
+		}
+	}
+	return tag
+}
+
+// jsonFieldName returns the name field is encoded as, or false if it is not encoded
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+
+	jsonTag := field.Tag.Get("json")
+	if jsonTag == "-" {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(jsonTag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+// isStructType tells if values of t are indexed by indexStruct
+func isStructType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// fieldIndexed tells if the field at key of documents of type t is indexed.
+// fields that cannot be found in t, for example in a map, are assumed to be.
+func fieldIndexed(t reflect.Type, key string) bool {
+	// an invalid schema is rejected by find
+	schema, _ := schemaOf(t)
+	all := !schema.NoIndex
+
+	for _, part := range strings.Split(key, ".") {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return true
+		}
+
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, ok := jsonFieldName(field)
+			if !ok || name != part {
+				continue
+			}
+
+			tag := parseFieldTag(field)
+			if tag.noindex {
+				return false
+			}
+			all = all || tag.index || tag.unique
+			t = field.Type
+			found = true
+			break
+		}
+		if !found {
+			return true
+		}
+	}
+
+	return all
+}
+
+// checkIndexed returns ErrNotIndexed if op or the order of q use a field of documents of type t that is not indexed
+func checkIndexed(model string, t reflect.Type, op Filter, q queryOpts) error {
+	if t == nil {
+		return nil
+	}
+
+	if q.order != nil && !fieldIndexed(t, q.order.key) {
+		return fmt.Errorf("%w: %s has no index on %q", ErrNotIndexed, model, q.order.key)
+	}
+
+	if op.op != filterScan {
+		for _, sub := range op.sub {
+			err := checkIndexed(model, t, sub, queryOpts{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if op.key != "" && !fieldIndexed(t, op.key) {
+		return fmt.Errorf("%w: %s has no index on %q", ErrNotIndexed, model, op.key)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type TagTestDoc struct {
+	ID   string
+	Name string
+	Body string         `kane:"noindex"`
+	Tags []string       `kane:"noindex"`
+	Meta map[string]any `kane:"noindex"`
+}
+
+func (d *TagTestDoc) PK() any {
+	return d.ID
+}
+
+type SchemaTestAddress struct {
+	City   string `kane:"index"`
+	Street string
+}
+
+type SchemaTestDoc struct {
+	ID      string `kane:"index"`
+	Email   string `json:"email" kane:"index"`
+	Body    string
+	Address SchemaTestAddress
+}
+
+func (d *SchemaTestDoc) PK() any {
+	return d.ID
+}
+
+func (d *SchemaTestDoc) Schema() ModelSchema {
+	return ModelSchema{NoIndex: true}
+}
+
+// schemaNameTest is the schema of SchemaNameTestDoc, changed by the tests
+var schemaNameTest ModelSchema
+
+type SchemaNameTestDoc struct {
+	ID   string
+	Done bool
+}
+
+func (d *SchemaNameTestDoc) PK() any {
+	return d.ID
+}
+
+func (d *SchemaNameTestDoc) Schema() ModelSchema {
+	return schemaNameTest
+}
+
+func TestSchema(t *testing.T) {
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		fields := func(t *testing.T, doc any, model string) []string {
+			keys, err := db.indexKeys(&StoredDocument{Val: doc}, []byte(model), []byte("12345678"))
+			if err != nil {
+				t.Fatalf("Failed to get index keys: %v", err)
+			}
+			var fields []string
+			for _, k := range keys {
+				k = k[len(indexPrefix(model))+1:]
+				fields = append(fields, string(k[:bytes.IndexByte(k, 0xff)]))
+			}
+			return fields
+		}
+
+		tagged := &TagTestDoc{
+			ID:   "schema-test-tagged",
+			Name: "Tagged",
+			Body: "a long text nobody queries",
+			Tags: []string{"a", "b"},
+			Meta: map[string]any{"Size": 1},
+		}
+		schema := &SchemaTestDoc{
+			ID:      "schema-test-schema",
+			Email:   "a@example.com",
+			Body:    "not indexed by default",
+			Address: SchemaTestAddress{City: "Berlin", Street: "Unter den Linden"},
+		}
+
+		t.Run("Keys", func(t *testing.T) {
+			got := fields(t, tagged, "TagTestDoc")
+			if len(got) != 2 || got[0] != "ID" || got[1] != "Name" {
+				t.Errorf("Expected only ID and Name to be indexed, got %v", got)
+			}
+
+			got = fields(t, schema, "SchemaTestDoc")
+			if len(got) != 3 || got[0] != "ID" || got[1] != "email" || got[2] != "Address.City" {
+				t.Errorf("Expected only tagged fields to be indexed, got %v", got)
+			}
+		})
+
+		if err := db.Put(ctx, tagged); err != nil {
+			t.Fatalf("Failed to put document: %v", err)
+		}
+		if err := db.Put(ctx, schema); err != nil {
+			t.Fatalf("Failed to put document: %v", err)
+		}
+
+		t.Run("Indexed", func(t *testing.T) {
+			var got TagTestDoc
+			if err := db.Get(ctx, &got, Eq("Name", "Tagged")); err != nil {
+				t.Errorf("Failed to get by indexed field: %v", err)
+			}
+
+			var got2 SchemaTestDoc
+			if err := db.Get(ctx, &got2, Eq("email", "a@example.com")); err != nil {
+				t.Errorf("Failed to get by tagged field: %v", err)
+			}
+			if err := db.Get(ctx, &got2, Eq("Address.City", "Berlin")); err != nil {
+				t.Errorf("Failed to get by tagged nested field: %v", err)
+			}
+		})
+
+		t.Run("NotIndexed", func(t *testing.T) {
+			for _, op := range []Filter{
+				Eq("Body", "a long text nobody queries"),
+				Has("Tags"),
+				Has("Meta.Size"),
+				And(Eq("Name", "Tagged"), Not(Eq("Body", "x"))),
+			} {
+				_, err := db.Count(ctx, TagTestDoc{}, op)
+				if !errors.Is(err, ErrNotIndexed) {
+					t.Errorf("Expected ErrNotIndexed, got %v", err)
+				}
+			}
+
+			for _, op := range []Filter{Eq("Body", "x"), Eq("Address.Street", "x")} {
+				var got SchemaTestDoc
+				err := db.Get(ctx, &got, op)
+				if !errors.Is(err, ErrNotIndexed) {
+					t.Errorf("Expected ErrNotIndexed, got %v", err)
+				}
+			}
+
+			for _, err := range Iter[TagTestDoc](ctx, db, Has("ID"), OrderBy("Body", Asc)) {
+				if !errors.Is(err, ErrNotIndexed) {
+					t.Errorf("Expected ErrNotIndexed ordering by a field that is not indexed, got %v", err)
+				}
+				break
+			}
+		})
+
+		t.Run("Names", func(t *testing.T) {
+			defer func() { schemaNameTest = ModelSchema{} }()
+			doc := &SchemaNameTestDoc{ID: "schema-test-names"}
+
+			for _, s := range []ModelSchema{
+				{Partial: []PartialIndex{{Name: "Done", Where: Eq("Done", false)}}},
+				{Partial: []PartialIndex{{Name: "ID.open", Where: Eq("Done", false)}}},
+				{Partial: []PartialIndex{{Name: "", Where: Eq("Done", false)}}},
+				{Partial: []PartialIndex{{Name: "open", Where: Eq("Done", false)}, {Name: "open", Where: Eq("Done", true)}}},
+				{Compound: []CompoundIndex{{"ID", "Done"}}, Partial: []PartialIndex{{Name: "ID,Done", Where: Eq("Done", false)}}},
+				{Funcs: []FuncIndex{IndexFunc("ID", func(d *SchemaNameTestDoc) []any { return []any{d.ID} })}},
+				{
+					Partial: []PartialIndex{{Name: "open", Where: Eq("Done", false)}},
+					Funcs:   []FuncIndex{IndexFunc("open", func(d *SchemaNameTestDoc) []any { return []any{!d.Done} })},
+				},
+			} {
+				schemaNameTest = s
+				err := db.Put(ctx, doc)
+				if !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("Expected ErrInvalidKey for %v, got %v", s, err)
+				}
+			}
+
+			schemaNameTest = ModelSchema{Partial: []PartialIndex{{Name: "open", Where: Eq("Done", false)}}}
+			if err := db.Put(ctx, doc); err != nil {
+				t.Errorf("Failed to put document: %v", err)
+			}
+			var got SchemaNameTestDoc
+			if err := db.Get(ctx, &got, Has("open")); err != nil {
+				t.Errorf("Failed to get by partial index: %v", err)
+			}
+			db.Del(ctx, doc)
+		})
+
+		db.Del(ctx, tagged)
+		db.Del(ctx, schema)
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-schema-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
@@ -0,0 +1,247 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/aep/kane/kv"
+)
+
+// a field tagged kane:"unique" is claimed for each of its values at
+//
+//	u 0xff <model> 0xff .<field> 0xff <value> 0xff
+//
+// which holds the object id of the document that has the value, the version of the write that claimed it,
+// and the path of the primary key pointer of the document.
+// like the primary key pointer, the claim is taken by CAS before the document is written,
+// and released after the document is written without the value, so a crash leaves at most claims behind
+// that nothing has anymore. those are taken over by the next write that claims the value,
+// after checking the document they point to.
+// documents written before the field was tagged have no claims, so before taking a claim that does not exist,
+// the index of the value is checked for another document that has it.
+
+// errClaimed is returned by claim if a concurrent write holds a claim, which may or may not keep the value.
+// it is retried like a locked primary key, even by Put, until the other write is done
+var errClaimed = fmt.Errorf("%w: unique value claimed by another write", ErrConflict)
+
+// uniqueFields returns the paths of the fields of documents of type t that are tagged kane:"unique"
+func uniqueFields(t reflect.Type) map[string]struct{} {
+	fields := map[string]struct{}{}
+	if t != nil {
+		uniqueFieldsI(t, "", fields, map[reflect.Type]bool{})
+	}
+	return fields
+}
+
+func uniqueFieldsI(t reflect.Type, path string, fields map[string]struct{}, seen map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := jsonFieldName(field)
+		if !ok {
+			continue
+		}
+		tag := parseFieldTag(field)
+		if tag.noindex {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+		if tag.unique {
+			fields[name] = struct{}{}
+		}
+		uniqueFieldsI(field.Type, name, fields, seen)
+	}
+}
+
+// claimKeys returns the unique claims of the index keys of unique fields
+func claimKeys(model []byte, keys [][]byte, fields map[string]struct{}) [][]byte {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	prefix := len(indexPrefix(string(model))) + 1
+	var claims [][]byte
+	for _, k := range keys {
+		field, _, ok := bytes.Cut(k[prefix:], []byte{0xff})
+		if !ok {
+			continue
+		}
+		if _, ok := fields[string(field)]; !ok {
+			continue
+		}
+		// the index key without the object id
+		claim := append([]byte{'u'}, k[1:len(k)-9]...)
+		claims = append(claims, claim)
+	}
+	return claims
+}
+
+// claimField returns the field a claim is for
+func claimField(model []byte, claim []byte) string {
+	field, _, _ := bytes.Cut(claim[len(indexPrefix(string(model)))+1:], []byte{0xff})
+	return string(field)
+}
+
+// claim takes the unique claims for the document with object id oid at pkpath, written as version vt.
+// typ is the type of the documents of model, to check if the documents that hold a claim still have its value.
+// it returns the claims that were taken from no or another document, to be released if the write fails.
+func (DB *DB) claim(ctx context.Context, model []byte, typ reflect.Type, claims [][]byte, oid []byte, vt uint64, pkpath []byte) ([][]byte, error) {
+	mine := append(bytes.Clone(oid), binary.LittleEndian.AppendUint64(nil, vt)...)
+	mine = append(mine, pkpath...)
+
+	var taken [][]byte
+	for _, claim := range claims {
+		cur, err := DB.KV.Get(ctx, claim)
+		if errors.Is(err, kv.ErrNotFound) {
+			cur = nil
+		} else if err != nil {
+			return taken, err
+		}
+
+		// already claimed by this document, but still swapped, so that a concurrent write
+		// that found the claim to be left behind cannot take it over
+		ours := len(cur) > 16 && bytes.Equal(cur[:8], oid) && bytes.Equal(cur[16:], pkpath)
+		if cur != nil && !ours {
+			err = DB.claimLive(ctx, model, typ, claim, cur)
+		} else if cur == nil {
+			err = DB.unclaimedLive(ctx, model, typ, claim, oid)
+		}
+		if err != nil {
+			return taken, err
+		}
+
+		_, swapped, err := DB.KV.CAS(ctx, claim, cur, mine)
+		if err != nil {
+			return taken, err
+		}
+		if !swapped {
+			return taken, errClaimed
+		}
+		if !ours {
+			taken = append(taken, claim)
+		}
+	}
+	return taken, nil
+}
+
+// claimLive returns a UniqueError if the document holding the claim cur still has its value
+func (DB *DB) claimLive(ctx context.Context, model []byte, typ reflect.Type, claim []byte, cur []byte) error {
+	if len(cur) <= 16 {
+		// not a claim
+		return nil
+	}
+	oid, pkpath := cur[:8], cur[16:]
+
+	ptr, err := DB.KV.Get(ctx, pkpath)
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(ptr) < 8 || !bytes.Equal(ptr[:8], oid) {
+		// the document was deleted, and maybe created again
+		return nil
+	}
+	if len(ptr) == 16 && time.Since(kv.VectorTimeToTime(binary.LittleEndian.Uint64(ptr[8:]))) < DB.writeLockTimeout() {
+		// it is being written, and may or may not keep the value
+		return errClaimed
+	}
+
+	b, err := DB.KV.Get(ctx, objectPath(oid))
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := DB.derivedKeys(string(model), typ, oid, b)
+	if err != nil {
+		// a broken object has no values that can be found
+		return nil
+	}
+	for _, c := range claimKeys(model, keys, map[string]struct{}{claimField(model, claim): {}}) {
+		if bytes.Equal(c, claim) {
+			return &UniqueError{Model: string(model), Field: claimField(model, claim)}
+		}
+	}
+	return nil
+}
+
+// unclaimedLive returns a UniqueError if a document other than oid has the value of claim,
+// which nothing claimed because the document was written before its field was tagged unique
+func (DB *DB) unclaimedLive(ctx context.Context, model []byte, typ reflect.Type, claim []byte, oid []byte) error {
+	// the index keys of the value, which are the claim followed by an object id
+	prefix := append([]byte{'f'}, claim[1:]...)
+
+	for k, err := range DB.KV.IterKeys(ctx, prefix, prefixEnd(prefix)) {
+		if err != nil {
+			return err
+		}
+		if len(k) != len(prefix)+9 || bytes.Equal(k[len(prefix):len(prefix)+8], oid) {
+			continue
+		}
+		other := k[len(prefix) : len(prefix)+8]
+
+		// the index key does not tell which primary key points to the object, but the object does
+		b, err := DB.KV.Get(ctx, objectPath(other))
+		if errors.Is(err, kv.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		val := reflect.New(typ).Interface()
+		if deserializeStore(b, &StoredDocument{Val: val}) != nil {
+			continue
+		}
+		pk, err := getPKFromAny(val)
+		if err != nil {
+			continue
+		}
+		pkpath := append([]byte{'k', 0xff}, model...)
+		pkpath = append(pkpath, 0xff)
+		pkpath = append(pkpath, pk...)
+		pkpath = append(pkpath, 0xff)
+
+		// checked like a claim of the other document
+		cur := append(bytes.Clone(other), make([]byte, 8)...)
+		err = DB.claimLive(ctx, model, typ, claim, append(cur, pkpath...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release deletes the claims that are held by the document with object id oid at pkpath.
+// it must be called under the lock of pkpath, so that no other write can take them over in between.
+func (DB *DB) release(ctx context.Context, claims [][]byte, oid []byte, pkpath []byte) {
+	for _, claim := range claims {
+		cur, err := DB.KV.Get(ctx, claim)
+		if err != nil || len(cur) <= 16 || !bytes.Equal(cur[:8], oid) || !bytes.Equal(cur[16:], pkpath) {
+			continue
+		}
+		// like unlock, check that it is still the same before deleting it
+		_, swapped, err := DB.KV.CAS(ctx, claim, cur, cur)
+		if err != nil || !swapped {
+			continue
+		}
+		DB.KV.Del(ctx, claim)
+	}
+}
@@ -0,0 +1,254 @@
+package kane
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type UniqueTestDoc struct {
+	ID    string
+	Email string `json:"email" kane:"unique"`
+	Name  string `kane:"noindex"`
+}
+
+func (d *UniqueTestDoc) PK() any {
+	return d.ID
+}
+
+func TestUnique(t *testing.T) {
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		var docs []*UniqueTestDoc
+		put := func(id string, email string) (*UniqueTestDoc, error) {
+			doc := &UniqueTestDoc{ID: id, Email: email}
+			err := db.Put(ctx, doc)
+			if err == nil {
+				docs = append(docs, doc)
+			}
+			return doc, err
+		}
+
+		expectUnique := func(t *testing.T, err error) {
+			var uerr *UniqueError
+			if !errors.As(err, &uerr) || !errors.Is(err, ErrUnique) {
+				t.Fatalf("Expected UniqueError, got %v", err)
+			}
+			if uerr.Model != "UniqueTestDoc" || uerr.Field != "email" {
+				t.Errorf("Expected UniqueError for UniqueTestDoc email, got %v", uerr)
+			}
+		}
+
+		claimOf := func(email string) []byte {
+			vbin, _ := indexVal(email)
+			k := append([]byte("u\xffUniqueTestDoc\xff.email\xff"), vbin...)
+			return append(k, 0xff)
+		}
+
+		t.Run("Put", func(t *testing.T) {
+			a, err := put("unique-test-a", "a@example.com")
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			_, err = put("unique-test-b", "a@example.com")
+			expectUnique(t, err)
+
+			var got UniqueTestDoc
+			if err := db.Get(ctx, &got, Eq("email", "a@example.com")); err != nil || got.ID != a.ID {
+				t.Errorf("Expected unique field to be indexed, got %v %v", got, err)
+			}
+		})
+
+		t.Run("Set", func(t *testing.T) {
+			b, err := put("unique-test-b", "b@example.com")
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+
+			// changing other fields keeps the claim
+			b.Name = "B"
+			if err := db.Set(ctx, b); err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+
+			b.Email = "a@example.com"
+			expectUnique(t, db.Set(ctx, b))
+
+			// the value is released when it is changed
+			b.Email = "c@example.com"
+			if err := db.Set(ctx, b); err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+			if _, err := put("unique-test-c", "b@example.com"); err != nil {
+				t.Errorf("Expected released value to be free, got %v", err)
+			}
+		})
+
+		t.Run("Del", func(t *testing.T) {
+			d, err := put("unique-test-d", "d@example.com")
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			if err := db.Del(ctx, d); err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+			if _, err := db.KV.Get(ctx, claimOf("d@example.com")); err == nil {
+				t.Errorf("Expected claim to be released")
+			}
+			if _, err := put("unique-test-e", "d@example.com"); err != nil {
+				t.Errorf("Expected value of deleted document to be free, got %v", err)
+			}
+		})
+
+		t.Run("LeftBehind", func(t *testing.T) {
+			// claims of a crashed write that never wrote its document
+			f, err := put("unique-test-f", "f@example.com")
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			pkpath := []byte("k\xffUniqueTestDoc\xff")
+			pk, _ := getPKFromAny(f)
+			pkpath = append(append(pkpath, pk...), 0xff)
+			oid, err := db.KV.Get(ctx, pkpath)
+			if err != nil {
+				t.Fatalf("Failed to read pointer: %v", err)
+			}
+
+			claim := append(binary.LittleEndian.AppendUint64(oid, 1), pkpath...)
+			db.KV.Set(ctx, claimOf("g@example.com"), claim)
+
+			gone := append(binary.LittleEndian.AppendUint64([]byte("12345678"), 1), "k\xffUniqueTestDoc\xffgone\xff"...)
+			db.KV.Set(ctx, claimOf("h@example.com"), gone)
+
+			if _, err := put("unique-test-g", "g@example.com"); err != nil {
+				t.Errorf("Expected claim of a document without the value to be taken over, got %v", err)
+			}
+			if _, err := put("unique-test-h", "h@example.com"); err != nil {
+				t.Errorf("Expected claim of a missing document to be taken over, got %v", err)
+			}
+		})
+
+		t.Run("Untagged", func(t *testing.T) {
+			// a document written before the field was tagged has no claim
+			i, err := put("unique-test-i", "i@example.com")
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+			db.KV.Del(ctx, claimOf(i.Email))
+
+			_, err = put("unique-test-j", "i@example.com")
+			expectUnique(t, err)
+
+			// and can still be written itself
+			i.Name = "I"
+			if err := db.Set(ctx, i); err != nil {
+				t.Errorf("Expected the document with the value to claim it, got %v", err)
+			}
+			if _, err := db.KV.Get(ctx, claimOf(i.Email)); err != nil {
+				t.Errorf("Expected the value to be claimed, got %v", err)
+			}
+		})
+
+		t.Run("ConcurrentPut", func(t *testing.T) {
+			var wg sync.WaitGroup
+			errs := make([]error, 10)
+			for i := range errs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					doc := &UniqueTestDoc{ID: fmt.Sprintf("unique-test-put-%d", i), Email: "put@example.com"}
+					errs[i] = db.Put(ctx, doc)
+				}()
+			}
+			wg.Wait()
+
+			ok := 0
+			for i, err := range errs {
+				if err == nil {
+					ok++
+					docs = append(docs, &UniqueTestDoc{ID: fmt.Sprintf("unique-test-put-%d", i)})
+					continue
+				}
+				expectUnique(t, err)
+			}
+			if ok != 1 {
+				t.Errorf("Expected exactly one put to succeed, got %d", ok)
+			}
+		})
+
+		t.Run("Concurrent", func(t *testing.T) {
+			var wg sync.WaitGroup
+			errs := make([]error, 10)
+			for i := range errs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					doc := &UniqueTestDoc{ID: fmt.Sprintf("unique-test-concurrent-%d", i), Email: "race@example.com"}
+					errs[i] = db.Set(ctx, doc)
+				}()
+			}
+			wg.Wait()
+
+			ok := 0
+			for i, err := range errs {
+				if err == nil {
+					ok++
+					docs = append(docs, &UniqueTestDoc{ID: fmt.Sprintf("unique-test-concurrent-%d", i)})
+					continue
+				}
+				expectUnique(t, err)
+			}
+			if ok != 1 {
+				t.Errorf("Expected exactly one write to succeed, got %d", ok)
+			}
+
+			n, err := db.Count(ctx, UniqueTestDoc{}, Eq("email", "race@example.com"))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if n != 1 {
+				t.Errorf("Expected one document with the value, got %d", n)
+			}
+		})
+
+		for _, doc := range docs {
+			db.Del(ctx, doc)
+		}
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-unique-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
@@ -0,0 +1,307 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/aep/kane/kv"
+)
+
+// IndexReport lists the index keys of one model that Verify found to be wrong
+type IndexReport struct {
+	// Documents is the number of documents that were checked
+	Documents int
+	// Missing are keys a document should have, but that are not in the index
+	Missing [][]byte
+	// Extra are keys in the index that no document should have
+	Extra [][]byte
+	// MisEncoded are extra keys that are not in the encoding of the current IndexVersion
+	MisEncoded [][]byte
+	// Unverified are keys of existing documents of a model without the Models option,
+	// which seem to be missing or extra when derived from the stored JSON, but may not be
+	Unverified [][]byte
+}
+
+// Verify derives the index keys of every document again and compares them with the index, per model.
+// keys of models passed with the Models option are derived from their Go type, like when they are written.
+// for other models they are derived from the stored JSON, which differs for fields that do not
+// encode to JSON the way they are indexed, like time.Time, []byte or omitempty, or are not indexed,
+// like kane:"noindex" and ModelSchema.NoIndex, and keys of fields that no stored JSON has,
+// like compound, partial and func indexes, are not checked.
+// so their keys of existing documents are only reported as Unverified, never as Missing or Extra.
+// with the Repair option, each document with wrong keys is checked again under its write lock and fixed.
+// models without the Models option only have their mis-encoded keys and the keys of documents that no longer exist deleted.
+// documents written while Verify runs may be reported, but are not repaired wrongly.
+// index keys of models without any documents are left to GC.
+func (DB *DB) Verify(ctx context.Context, opts ...Opt) (map[string]*IndexReport, error) {
+	q := parseOpts(opts)
+
+	vt, err := DB.KV.GetVectorTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// keys of documents created since may not have a pointer yet
+	cutoff := kv.VectorTimeToTime(vt).Add(-DB.writeLockTimeout())
+
+	reports := map[string]*IndexReport{}
+
+	var model string
+	var ptrs []kv.KeyAndValue
+	verifyModel := func() error {
+		if len(ptrs) == 0 {
+			return nil
+		}
+		r, err := DB.verifyModel(ctx, model, q.models[model], ptrs, cutoff, q.repair)
+		if err != nil {
+			return err
+		}
+		reports[model] = r
+		ptrs = nil
+		return nil
+	}
+
+	start := []byte{'k', 0xff}
+	for p, err := range DB.KV.Iter(ctx, start, prefixEnd(start)) {
+		if err != nil {
+			return nil, err
+		}
+		end := bytes.IndexByte(p.K[2:], 0xff)
+		if end < 0 || (len(p.V) != 8 && len(p.V) != 16) {
+			continue
+		}
+		if m := string(p.K[2 : 2+end]); m != model {
+			err = verifyModel()
+			if err != nil {
+				return nil, err
+			}
+			model = m
+		}
+		ptrs = append(ptrs, p)
+	}
+	err = verifyModel()
+	if err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// verifyModel compares the index of model with the keys of the documents ptrs point to
+func (DB *DB) verifyModel(ctx context.Context, model string, typ reflect.Type, ptrs []kv.KeyAndValue, cutoff time.Time, repair bool) (*IndexReport, error) {
+	r := &IndexReport{}
+	expected := map[string]struct{}{}
+	live := map[[8]byte][]byte{}
+
+	// documents that are being written, or cannot be read, have no known keys
+	unknown := map[[8]byte]struct{}{}
+
+	// without the type, keys of fields that are not in the stored JSON, like compound, partial and func indexes, cannot be checked
+	fields := map[string]struct{}{}
+	prefix := indexPrefix(model)
+
+	for chunk := range slices.Chunk(ptrs, 1000) {
+		paths := make([][]byte, len(chunk))
+		for i, p := range chunk {
+			paths[i] = objectPath(p.V[:8])
+		}
+		objects, err := DB.KV.BatchGet(ctx, paths)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, p := range chunk {
+			oid := [8]byte(p.V[:8])
+			live[oid] = p.K
+			if len(p.V) == 16 || objects[i] == nil {
+				unknown[oid] = struct{}{}
+				continue
+			}
+
+			keys, err := DB.derivedKeys(model, typ, oid[:], objects[i])
+			if err != nil {
+				unknown[oid] = struct{}{}
+				continue
+			}
+			r.Documents++
+			for _, k := range keys {
+				expected[string(k)] = struct{}{}
+				if typ == nil {
+					field, _, _ := bytes.Cut(k[len(prefix):], []byte{0xff})
+					fields[string(field)] = struct{}{}
+				}
+			}
+		}
+	}
+
+	for k, err := range DB.KV.IterKeys(ctx, prefix, prefixEnd(prefix)) {
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := expected[string(k)]; ok {
+			delete(expected, string(k))
+			continue
+		}
+
+		// field, value and object id
+		if len(k) < len(prefix)+12 || k[len(k)-1] != 0xff || k[len(k)-10] != 0xff {
+			r.MisEncoded = append(r.MisEncoded, k)
+			continue
+		}
+		oid := [8]byte(k[len(k)-9 : len(k)-1])
+		if _, ok := unknown[oid]; ok {
+			continue
+		}
+		if _, ok := live[oid]; !ok && !kv.VectorTimeToTime(binary.LittleEndian.Uint64(oid[:])).Before(cutoff) {
+			continue
+		}
+
+		field := k[len(prefix) : len(k)-10]
+		sep := bytes.IndexByte(field, 0xff)
+		if typ == nil && sep >= 0 {
+			if _, ok := fields[string(field[:sep])]; !ok {
+				continue
+			}
+		}
+		if field[0] != '.' || sep < 0 || !validIndexVal(field[sep+1:]) {
+			r.MisEncoded = append(r.MisEncoded, k)
+		} else if _, ok := live[oid]; ok && typ == nil {
+			r.Unverified = append(r.Unverified, k)
+		} else {
+			r.Extra = append(r.Extra, k)
+		}
+	}
+
+	missing := &r.Missing
+	if typ == nil {
+		missing = &r.Unverified
+	}
+	for k := range expected {
+		*missing = append(*missing, []byte(k))
+	}
+	slices.SortFunc(r.Missing, bytes.Compare)
+	slices.SortFunc(r.Unverified, bytes.Compare)
+
+	if repair {
+		err := DB.repairIndex(ctx, model, typ, r, live)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// derivedKeys decodes the stored object b into typ, or generic JSON if typ is nil, and returns its index keys
+func (DB *DB) derivedKeys(model string, typ reflect.Type, oid []byte, b []byte) ([][]byte, error) {
+	var val any = &map[string]any{}
+	if typ != nil {
+		val = reflect.New(typ).Interface()
+	}
+
+	doc := &StoredDocument{Val: val}
+	err := deserializeStore(b, doc)
+	if err != nil {
+		return nil, err
+	}
+	return DB.indexKeys(doc, []byte(model), oid)
+}
+
+// repairIndex fixes the keys r found to be wrong
+func (DB *DB) repairIndex(ctx context.Context, model string, typ reflect.Type, r *IndexReport, live map[[8]byte][]byte) error {
+	keys := slices.Concat(r.Missing, r.Extra, r.MisEncoded)
+	if typ == nil {
+		// keys derived from the stored JSON differ from the real ones for some fields,
+		// so only keys that no document can have are deleted, which Extra only has without the type
+		for _, k := range keys {
+			err := DB.KV.Del(ctx, k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	byDoc := map[[8]byte][][]byte{}
+	for _, k := range keys {
+		if len(k) < 10 {
+			// not even an object id, so no document can have it
+			err := DB.KV.Del(ctx, k)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		oid := [8]byte(k[len(k)-9 : len(k)-1])
+		byDoc[oid] = append(byDoc[oid], k)
+	}
+
+	for oid, keys := range byDoc {
+		pkpath, ok := live[oid]
+		if !ok {
+			// nothing points to the document anymore, so none of its keys are needed
+			DB.delKeys(ctx, keys)
+			continue
+		}
+
+		err := DB.repairDocument(ctx, model, typ, pkpath, oid[:], keys)
+		if err != nil && !errors.Is(err, errLocked) {
+			// a document being written gets its keys fixed by the write
+			return err
+		}
+	}
+	return nil
+}
+
+// repairDocument adds or deletes the keys of object oid that are wrong, under the write lock of pkpath.
+// it returns errLocked if the document is being written
+func (DB *DB) repairDocument(ctx context.Context, model string, typ reflect.Type, pkpath []byte, oid []byte, keys [][]byte) error {
+	vt, err := DB.KV.GetVectorTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, locked, err := DB.lock(ctx, pkpath, vt, false)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cur := locked[:8]
+	if !bytes.Equal(cur, oid) {
+		return DB.unlock(ctx, pkpath, locked, cur)
+	}
+
+	b, err := DB.KV.Get(ctx, objectPath(oid))
+	if err != nil {
+		DB.unlock(ctx, pkpath, locked, cur)
+		if errors.Is(err, kv.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	want, err := DB.derivedKeys(model, typ, oid, b)
+	if err != nil {
+		return DB.unlock(ctx, pkpath, locked, cur)
+	}
+
+	for _, k := range keys {
+		if slices.ContainsFunc(want, func(w []byte) bool { return bytes.Equal(w, k) }) {
+			err = DB.KV.Set(ctx, k, []byte{0xff})
+		} else {
+			err = DB.KV.Del(ctx, k)
+		}
+		if err != nil {
+			DB.unlock(ctx, pkpath, locked, cur)
+			return err
+		}
+	}
+
+	return DB.unlock(ctx, pkpath, locked, cur)
+}
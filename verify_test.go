@@ -0,0 +1,223 @@
+package kane
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+type VerifyTestDoc struct {
+	ID   string
+	Name string
+	When time.Time
+	Blob string `kane:"noindex"`
+}
+
+func (d *VerifyTestDoc) PK() any {
+	return d.ID
+}
+
+func TestVerify(t *testing.T) {
+	runTests := func(t *testing.T, db *DB) {
+		ctx := context.Background()
+
+		oidOf := func(t *testing.T, doc *VerifyTestDoc) []byte {
+			pk, _ := getPKFromAny(doc)
+			path := append([]byte("k\xffVerifyTestDoc\xff"), pk...)
+			oid, err := db.KV.Get(ctx, append(path, 0xff))
+			if err != nil {
+				t.Fatalf("Failed to read pointer: %v", err)
+			}
+			return oid
+		}
+
+		nameKey := func(vbin []byte, oid []byte) []byte {
+			k := append(indexPrefix("VerifyTestDoc"), ".Name\xff"...)
+			k = append(k, vbin...)
+			k = append(k, 0xff)
+			k = append(k, oid...)
+			return append(k, 0xff)
+		}
+
+		contains := func(keys [][]byte, k []byte) bool {
+			return slices.ContainsFunc(keys, func(f []byte) bool { return bytes.Equal(f, k) })
+		}
+
+		a := &VerifyTestDoc{ID: "verify-test-a", Name: "A", When: time.Now(), Blob: "a"}
+		b := &VerifyTestDoc{ID: "verify-test-b", Name: "B", When: time.Now(), Blob: "b"}
+		for _, doc := range []*VerifyTestDoc{a, b} {
+			if err := db.Put(ctx, doc); err != nil {
+				t.Fatalf("Failed to put document %s: %v", doc.ID, err)
+			}
+		}
+		aOid := oidOf(t, a)
+		bOid := oidOf(t, b)
+
+		aName, _ := indexVal("A")
+		ghostName, _ := indexVal("Ghost")
+		v1Name, _ := indexValV1("B")
+		oldOid := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().Add(-time.Hour).UnixMilli())<<18)
+
+		missing := nameKey(aName, aOid)
+		extra := nameKey(ghostName, bOid)
+		dangling := nameKey(ghostName, oldOid)
+		misEncoded := nameKey(v1Name, bOid)
+
+		db.KV.Del(ctx, missing)
+		db.KV.Set(ctx, extra, []byte{0xff})
+		db.KV.Set(ctx, dangling, []byte{0xff})
+		db.KV.Set(ctx, misEncoded, []byte{0xff})
+
+		check := func(t *testing.T, r *IndexReport) {
+			if r == nil {
+				t.Fatalf("Expected a report for VerifyTestDoc")
+			}
+			if r.Documents != 2 {
+				t.Errorf("Expected 2 documents, got %d", r.Documents)
+			}
+			if len(r.Missing) != 1 || !bytes.Equal(r.Missing[0], missing) {
+				t.Errorf("Expected %q to be missing, got %q", missing, r.Missing)
+			}
+			if len(r.Extra) != 2 || !contains(r.Extra, extra) || !contains(r.Extra, dangling) {
+				t.Errorf("Expected %q and %q to be extra, got %q", extra, dangling, r.Extra)
+			}
+			if len(r.MisEncoded) != 1 || !bytes.Equal(r.MisEncoded[0], misEncoded) {
+				t.Errorf("Expected %q to be mis-encoded, got %q", misEncoded, r.MisEncoded)
+			}
+		}
+
+		t.Run("Typed", func(t *testing.T) {
+			reports, err := db.Verify(ctx, Models(VerifyTestDoc{}))
+			if err != nil {
+				t.Fatalf("Failed to verify: %v", err)
+			}
+			check(t, reports["VerifyTestDoc"])
+		})
+
+		t.Run("Untyped", func(t *testing.T) {
+			reports, err := db.Verify(ctx)
+			if err != nil {
+				t.Fatalf("Failed to verify: %v", err)
+			}
+			r := reports["VerifyTestDoc"]
+			if r == nil {
+				t.Fatalf("Expected a report for VerifyTestDoc")
+			}
+
+			// keys of existing documents cannot be checked without the type,
+			// for example time.Time is stored as a string, but not indexed, and Blob is not indexed at all
+			when := append(indexPrefix("VerifyTestDoc"), ".When\xff"...)
+			blob := append(indexPrefix("VerifyTestDoc"), ".Blob\xff"...)
+			if len(r.Missing) != 0 {
+				t.Errorf("Expected no missing keys without the type, got %q", r.Missing)
+			}
+			if !contains(r.Unverified, missing) || !contains(r.Unverified, extra) {
+				t.Errorf("Expected %q and %q to be unverified, got %q", missing, extra, r.Unverified)
+			}
+			for _, k := range r.Unverified {
+				if !bytes.Equal(k, missing) && !bytes.Equal(k, extra) && !bytes.HasPrefix(k, when) && !bytes.HasPrefix(k, blob) {
+					t.Errorf("Expected only %q, %q, When and Blob keys to be unverified, got %q", missing, extra, k)
+				}
+			}
+			if len(r.Extra) != 1 || !bytes.Equal(r.Extra[0], dangling) || len(r.MisEncoded) != 1 {
+				t.Errorf("Expected %q to be extra and 1 mis-encoded key, got %q and %q", dangling, r.Extra, r.MisEncoded)
+			}
+		})
+
+		t.Run("Repair", func(t *testing.T) {
+			reports, err := db.Verify(ctx, Models(VerifyTestDoc{}), Repair())
+			if err != nil {
+				t.Fatalf("Failed to repair: %v", err)
+			}
+			check(t, reports["VerifyTestDoc"])
+
+			reports, err = db.Verify(ctx, Models(VerifyTestDoc{}))
+			if err != nil {
+				t.Fatalf("Failed to verify: %v", err)
+			}
+			r := reports["VerifyTestDoc"]
+			if len(r.Missing) != 0 || len(r.Extra) != 0 || len(r.MisEncoded) != 0 {
+				t.Errorf("Expected a clean index after repair, got %q %q %q", r.Missing, r.Extra, r.MisEncoded)
+			}
+
+			n, err := db.Count(ctx, VerifyTestDoc{}, Eq("Name", "A"))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if n != 1 {
+				t.Errorf("Expected repaired document to be found, got %d", n)
+			}
+
+			got, err := GetPK[VerifyTestDoc](ctx, db, b.ID)
+			if err != nil || got.Name != "B" {
+				t.Errorf("Expected document to be unchanged by repair, got %v %v", got, err)
+			}
+		})
+
+		t.Run("UntypedRepair", func(t *testing.T) {
+			db.KV.Del(ctx, missing)
+			db.KV.Set(ctx, extra, []byte{0xff})
+			db.KV.Set(ctx, dangling, []byte{0xff})
+			db.KV.Set(ctx, misEncoded, []byte{0xff})
+
+			_, err := db.Verify(ctx, Repair())
+			if err != nil {
+				t.Fatalf("Failed to repair: %v", err)
+			}
+
+			// keys derived from the stored JSON are not trusted for documents that exist
+			reports, err := db.Verify(ctx, Models(VerifyTestDoc{}))
+			if err != nil {
+				t.Fatalf("Failed to verify: %v", err)
+			}
+			r := reports["VerifyTestDoc"]
+			if len(r.Missing) != 1 || !bytes.Equal(r.Missing[0], missing) {
+				t.Errorf("Expected only %q to be missing, got %q", missing, r.Missing)
+			}
+			if len(r.Extra) != 1 || !bytes.Equal(r.Extra[0], extra) {
+				t.Errorf("Expected only %q to be extra, got %q", extra, r.Extra)
+			}
+			if len(r.MisEncoded) != 0 {
+				t.Errorf("Expected mis-encoded keys to be deleted, got %q", r.MisEncoded)
+			}
+		})
+
+		db.Del(ctx, a)
+		db.Del(ctx, b)
+	}
+
+	// Run tests with Pebble
+	t.Run("Pebble", func(t *testing.T) {
+		tempDir, err := os.MkdirTemp("", "pebble-verify-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		dbPath := filepath.Join(tempDir, "db")
+		db, err := Init("pebble://" + dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDB: %v", err)
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+
+	// Run tests with TiKV - skip if not available
+	t.Run("TiKV", func(t *testing.T) {
+		db, err := Init("tikv://127.0.0.1:2379")
+		if err != nil {
+			t.Skipf("Failed to connect to TiKV, skipping test: %v", err)
+			return
+		}
+		defer db.Close()
+
+		runTests(t, db)
+	})
+}
@@ -1,154 +1,505 @@
 package kane
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
 	"time"
+
+	"github.com/aep/kane/kv"
 )
 
-func (DB *DB) Del(ctx context.Context, old any) error {
-	return DB.swap(ctx, nil, old, true)
+func (DB *DB) Del(ctx context.Context, old any, opts ...Opt) error {
+	return DB.swap(ctx, nil, old, true, 0, opts)
 }
 
 // create an object. errors if an object with the same primary key exists
 func (DB *DB) Put(ctx context.Context, doc any) error {
-	return DB.swap(ctx, doc, nil, false)
+	return DB.swap(ctx, doc, nil, false, 0, nil)
 }
 
 // set an object. overwrites any existing object with the same primary key
-func (DB *DB) Set(ctx context.Context, doc any) error {
-	return DB.swap(ctx, doc, nil, true)
+func (DB *DB) Set(ctx context.Context, doc any, opts ...Opt) error {
+	return DB.swap(ctx, doc, nil, true, 0, opts)
 }
 
 // set an object and delete and return any previous object with the same primary key if it existed
-func (DB *DB) Swap(ctx context.Context, doc any, old any) error {
-	return DB.swap(ctx, doc, old, true)
+func (DB *DB) Swap(ctx context.Context, doc any, old any, opts ...Opt) error {
+	return DB.swap(ctx, doc, old, true, 0, opts)
+}
+
+// update an object, but only if it is still at ifVersion, see StoredDocument.Version.
+// errors with ErrConflict if it was changed since, or ErrNotFound if it no longer exists.
+// if doc is a *StoredDocument, its Version is set to the new version.
+func (DB *DB) Update(ctx context.Context, doc any, ifVersion uint64) error {
+	if ifVersion == 0 {
+		return docError(ErrNotFound, getModelFromAny(doc), pkOf(doc))
+	}
+	return DB.swap(ctx, doc, nil, false, ifVersion, nil)
+}
+
+// DefaultWriteLockTimeout is used if DB.WriteLockTimeout is not set
+const DefaultWriteLockTimeout = 10 * time.Second
+
+// writeLockTimeout returns how long a write may hold the lock of a primary key.
+// after that, other writes assume it crashed and take the lock over.
+func (DB *DB) writeLockTimeout() time.Duration {
+	if DB.WriteLockTimeout > 0 {
+		return DB.WriteLockTimeout
+	}
+	return DefaultWriteLockTimeout
 }
 
-func (DB *DB) swap(ctx context.Context, doc any, old any, retry bool) error {
-	var ots []byte
+var (
+	// errLocked is returned by lock if another write holds the lock
+	errLocked = fmt.Errorf("%w: locked by another write", ErrConflict)
+
+	// errExpired is returned by a write that held the lock for too long, so another write may have taken it over
+	errExpired = fmt.Errorf("%w: write lock expired", ErrConflict)
+
+	// errChanged is returned by Update if the document is no longer at the expected version
+	errChanged = fmt.Errorf("%w: changed by another write", ErrConflict)
+)
+
+// swap replaces the current object of the primary key of doc or old with doc,
+// and loads the replaced object into old if it is not nil.
+// if ifVersion is not 0, it only replaces that version.
+// if retry is set, it waits for concurrent writes according to the RetryPolicy of opts,
+// and it always waits for concurrent writes of the same unique value, to tell if they keep it.
+//
+// the primary key pointer k holds the object id, which stays the same for the lifetime of a document,
+// so that index keys of unchanged fields stay the same too, and only the difference is written.
+// while a write is in progress, the pointer also holds the new version, which locks it for other writes.
+// a lock older than DB.WriteLockTimeout is taken over, so a write checks that it still holds the lock
+// before each step that changes what other writes see, and gives up after half of the timeout.
+// new index keys are written before the object and the object before old index keys are removed,
+// so a crash leaves at most extra index keys behind, never missing ones.
+func (DB *DB) swap(ctx context.Context, doc any, old any, retry bool, ifVersion uint64, opts []Opt) error {
 	var pk []byte
 	var model string
+	var err error
 
 	if doc == nil {
-		var err error
 		pk, err = getPKFromAny(old)
-		if err != nil {
-			return err
-		}
 		model = getModelFromAny(old)
 	} else {
-
-		var err error
 		pk, err = getPKFromAny(doc)
+		model = getModelFromAny(doc)
+	}
+	if err != nil {
+		return err
+	}
+
+	var sdoc *StoredDocument
+	if doc != nil {
+		if !strings.HasPrefix(reflect.TypeOf(doc).String(), "*kane.StoredDocument") {
+			doc = &StoredDocument{Val: doc}
+		}
+		sdoc = doc.(*StoredDocument)
+	}
+
+	if sdoc != nil {
+		schema, err := schemaOf(docType(sdoc))
 		if err != nil {
 			return err
 		}
-		model = getModelFromAny(doc)
-
-		ots_, err := DB.KV.GetVectorTime(ctx)
+		// the first document of a model is written with all of its indexes, so they are built
+		_, err = DB.builtIndexes(ctx, model, schema)
 		if err != nil {
 			return err
 		}
-		var ots__ [8]byte
-		binary.LittleEndian.PutUint64(ots__[:], ots_)
-		ots = ots__[:]
+	}
 
-		path := []byte{'o', 0xff, ots[0], ots[1], ots[2], ots[3], ots[4], ots[5], ots[6], ots[7], 0xff}
+	pkpath := append([]byte{'k', 0xff}, model...)
+	pkpath = append(pkpath, 0xff)
+	pkpath = append(pkpath, pk...)
+	pkpath = append(pkpath, 0xff)
 
-		if !strings.HasPrefix(reflect.TypeOf(doc).String(), "*kane.StoredDocument") {
-			doc = &StoredDocument{Val: doc}
+	policy := DB.retryPolicy(opts)
+	for n := 1; ; n++ {
+		err = DB.swapLocked(ctx, []byte(model), pkpath, sdoc, old, retry, ifVersion)
+		if errors.Is(err, errLocked) || errors.Is(err, errChanged) || errors.Is(err, errClaimed) {
+			DB.stats.conflicts.Add(1)
+		}
+		if !(retry && errors.Is(err, errLocked)) && !errors.Is(err, errClaimed) {
+			break
+		}
+		again, cerr := DB.retry(ctx, policy, n)
+		if cerr != nil {
+			return cerr
 		}
+		if !again {
+			break
+		}
+	}
+
+	if doc == nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		doc = old
+	}
+	if errors.Is(err, ErrConflict) || errors.Is(err, ErrNotFound) {
+		return docError(err, model, pkOf(doc))
+	}
+	return err
+}
 
-		b, err := serializeStore(doc)
+// swapLocked does one attempt of swap under the lock of pkpath
+func (DB *DB) swapLocked(ctx context.Context, model []byte, pkpath []byte, sdoc *StoredDocument, old any, retry bool, ifVersion uint64) error {
+	vt, err := DB.KV.GetVectorTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	create := sdoc != nil && ifVersion == 0
+	prevptr, locked, err := DB.lock(ctx, pkpath, vt, create)
+	if err != nil {
+		return err
+	}
+	oid := locked[:8]
+	opath := objectPath(oid)
+	takeover := len(prevptr) == 16
+
+	// cleanup must not be stopped by ctx, or the lock would stay until it times out
+	cctx := context.WithoutCancel(ctx)
+
+	// fence fails once the lock may have been taken over, after which nothing must be changed or cleaned up,
+	// since it would change the document of the write that took over
+	lockedAt := kv.VectorTimeToTime(vt)
+	fence := func() error {
+		if time.Since(lockedAt) > DB.writeLockTimeout()/2 {
+			return errExpired
+		}
+		_, swapped, err := DB.KV.CAS(ctx, pkpath, locked, locked)
 		if err != nil {
 			return err
 		}
+		if !swapped {
+			return errExpired
+		}
+		return nil
+	}
+	abort := func(err error) error {
+		if prevptr == nil {
+			DB.unlock(cctx, pkpath, locked, nil)
+		} else {
+			DB.unlock(cctx, pkpath, locked, oid)
+		}
+		return err
+	}
+
+	// the current object, decoded into the same type as the new one so that their index keys compare
+	var prev *StoredDocument
+	var prevKeys [][]byte
+	known := true
 
-		err = DB.KV.Set(ctx, path, b)
+	b, err := DB.KV.Get(ctx, opath)
+	if err != nil && !errors.Is(err, kv.ErrNotFound) {
+		return abort(err)
+	}
+	if err == nil {
+		prev = prevDocument(old, sdoc)
+		prev.Version = 0
+
+		err = deserializeStore(b, prev)
+		if err == nil {
+			if prev.Version == 0 {
+				prev.Version = binary.LittleEndian.Uint64(oid)
+			}
+			prevKeys, err = DB.indexKeys(prev, model, oid)
+		}
 		if err != nil {
-			return err
+			// a broken object cannot be diffed against, so all new keys are written
+			// and its own keys stay behind
+			known = false
+		} else if takeover {
+			// the crashed write may have removed some of them already
+			err = DB.setKeys(ctx, prevKeys)
+			if err != nil {
+				return abort(err)
+			}
 		}
-		err = DB.index(ctx, doc.(*StoredDocument), []byte(model), ots[:], true)
+	}
+
+	if sdoc == nil {
+		if prev == nil {
+			// there is only a pointer left behind by a crashed write
+			DB.unlock(cctx, pkpath, locked, nil)
+			return ErrNotFound
+		}
+		err = fence()
 		if err != nil {
-			DB.KV.Del(ctx, path)
 			return err
 		}
+		for _, k := range prevKeys {
+			DB.KV.Del(ctx, k)
+		}
+		err = DB.KV.Del(ctx, opath)
+		if err != nil {
+			return abort(err)
+		}
+		DB.release(cctx, claimKeys(model, prevKeys, uniqueFields(docType(prev))), oid, pkpath)
+		return DB.unlock(cctx, pkpath, locked, nil)
+	}
 
-		if pk == nil {
-			return nil
+	if ifVersion != 0 {
+		if prev == nil {
+			return abort(ErrNotFound)
 		}
+		if !known || prev.Version != ifVersion {
+			return abort(errChanged)
+		}
+	} else if prev != nil && !retry {
+		return abort(ErrConflict)
+	}
 
+	now := kv.VectorTimeToTime(vt)
+	created := now
+	if prev != nil && prev.History != nil && prev.History.Created != nil {
+		created = *prev.History.Created
 	}
+	sdoc.History = &History{Created: &created, Updated: &now}
+	sdoc.Version = vt
 
-	pkpath := append([]byte{'k', 0xff}, model...)
-	pkpath = append(pkpath, 0xff)
-	pkpath = append(pkpath, pk...)
-	pkpath = append(pkpath, 0xff)
+	keys, err := DB.indexKeys(sdoc, model, oid)
+	if err != nil {
+		return abort(err)
+	}
+	b, err = serializeStore(sdoc)
+	if err != nil {
+		return abort(err)
+	}
 
-	var err error
-	var oldots []byte
+	adds, removes := keys, [][]byte(nil)
+	if known {
+		adds, removes = diffKeys(prevKeys, keys)
+	}
 
-	for {
-		var swapped bool
-		oldots, swapped, err = DB.KV.CAS(ctx, pkpath, oldots, ots[:])
-		if err != nil {
+	// unique values are claimed before anything is written, and all of them on every write,
+	// so that documents written before a field was tagged unique get their claims too
+	unique := uniqueFields(docType(sdoc))
+	taken, err := DB.claim(ctx, model, docType(sdoc), claimKeys(model, keys, unique), oid, vt, pkpath)
+	if err != nil {
+		DB.release(cctx, taken, oid, pkpath)
+		return abort(err)
+	}
 
-			if ots != nil {
-				DB.index(ctx, doc.(*StoredDocument), []byte(model), ots[:], false)
-				DB.KV.Del(ctx, []byte{'o', 0xff, ots[0], ots[1], ots[2], ots[3], ots[4], ots[5], ots[6], ots[7], 0xff})
-			}
+	err = DB.setKeys(ctx, adds)
+	if err == nil {
+		err = fence()
+		if errors.Is(err, errExpired) {
+			// the new keys are extra keys of a document that another write owns now
 			return err
 		}
+	}
+	if err == nil {
+		err = DB.KV.Set(ctx, opath, b)
+	}
+	if err != nil {
+		DB.delKeys(cctx, adds)
+		DB.release(cctx, taken, oid, pkpath)
+		return abort(err)
+	}
 
-		if swapped {
-			if ots == nil {
-				DB.KV.Del(ctx, pkpath)
-			}
-			break
+	// the document is written. keys that fail to be removed are collected by GC with the Models option,
+	// and claims are taken over by the next write of the value
+	err = fence()
+	if err != nil {
+		return err
+	}
+	DB.delKeys(cctx, removes)
+	DB.release(cctx, claimKeys(model, removes, unique), oid, pkpath)
+
+	return DB.unlock(cctx, pkpath, locked, oid)
+}
+
+// prevDocument returns what swap decodes the current object into: old, if it can be loaded into,
+// or else a new document of the type of old, or of sdoc if old is nil
+func prevDocument(old any, sdoc *StoredDocument) *StoredDocument {
+	if s, ok := old.(StoredDocument); ok {
+		old = &s
+	}
+	prev, _ := old.(*StoredDocument)
+	if prev == nil {
+		prev = &StoredDocument{Val: old}
+	}
+
+	// JSON decodes into a value that is not a pointer as a map, which has no schema
+	if v := reflect.ValueOf(prev.Val); !v.IsValid() || v.Kind() != reflect.Ptr || v.IsNil() {
+		t := reflect.TypeOf(prev.Val)
+		if t == nil && sdoc != nil {
+			t = reflect.TypeOf(sdoc.Val)
+		}
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
 		}
+		if t != nil {
+			prev.Val = reflect.New(t).Interface()
+		}
+	}
+	return prev
+}
+
+// lock takes the write lock of the primary key pointer at pkpath for version vt.
+// it returns the pointer as it was, and as it is now while locked.
+// a locked pointer is the object id followed by the version of the write holding the lock.
+// if there is no document yet, the lock is only taken if create is set, with vt as the object id.
+func (DB *DB) lock(ctx context.Context, pkpath []byte, vt uint64, create bool) ([]byte, []byte, error) {
+	cur, err := DB.KV.Get(ctx, pkpath)
+	if errors.Is(err, kv.ErrNotFound) {
+		cur = nil
+	} else if err != nil {
+		return nil, nil, err
+	}
 
-		if !retry {
-			return fmt.Errorf("conflict")
+	version := binary.LittleEndian.AppendUint64(nil, vt)
+
+	var next []byte
+	switch len(cur) {
+	case 0:
+		if !create {
+			return nil, nil, ErrNotFound
+		}
+		cur = nil
+		next = append(bytes.Clone(version), version...)
+	case 8:
+		next = append(bytes.Clone(cur), version...)
+	case 16:
+		held := binary.LittleEndian.Uint64(cur[8:])
+		if time.Since(kv.VectorTimeToTime(held)) < DB.writeLockTimeout() {
+			return nil, nil, errLocked
 		}
+		next = append(bytes.Clone(cur[:8]), version...)
+	default:
+		return nil, nil, fmt.Errorf("invalid primary key pointer %x", cur)
+	}
 
-		select {
-		case <-ctx.Done():
-			if ots != nil {
-				DB.index(ctx, doc.(*StoredDocument), []byte(model), ots[:], false)
-				DB.KV.Del(ctx, []byte{'o', 0xff, ots[0], ots[1], ots[2], ots[3], ots[4], ots[5], ots[6], ots[7], 0xff})
-			}
-			return ctx.Err()
-		default:
+	_, swapped, err := DB.KV.CAS(ctx, pkpath, cur, next)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !swapped {
+		return nil, nil, errLocked
+	}
+	return cur, next, nil
+}
+
+// unlock releases the lock taken by lock, and sets the pointer to oid, or deletes it if oid is nil
+func (DB *DB) unlock(ctx context.Context, pkpath []byte, locked []byte, oid []byte) error {
+	next := oid
+	if next == nil {
+		next = locked
+	}
+	_, swapped, err := DB.KV.CAS(ctx, pkpath, locked, next)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return errExpired
+	}
+	if oid == nil {
+		return DB.KV.Del(ctx, pkpath)
+	}
+	return nil
+}
+
+func objectPath(oid []byte) []byte {
+	path := append([]byte{'o', 0xff}, oid...)
+	return append(path, 0xff)
+}
+
+func (DB *DB) setKeys(ctx context.Context, keys [][]byte) error {
+	for _, k := range keys {
+		err := DB.KV.Set(ctx, k, []byte{0xff})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (DB *DB) delKeys(ctx context.Context, keys [][]byte) {
+	for _, k := range keys {
+		DB.KV.Del(ctx, k)
+	}
+}
+
+// diffKeys returns the keys only in next, and the keys only in prev
+func diffKeys(prev [][]byte, next [][]byte) ([][]byte, [][]byte) {
+	inPrev := make(map[string]bool, len(prev))
+	for _, k := range prev {
+		inPrev[string(k)] = true
+	}
+	inNext := make(map[string]bool, len(next))
+	for _, k := range next {
+		inNext[string(k)] = true
+	}
+
+	var adds, removes [][]byte
+	for _, k := range next {
+		if !inPrev[string(k)] {
+			adds = append(adds, k)
+			inPrev[string(k)] = true
 		}
-		time.Sleep(time.Millisecond * 10)
-		continue
 	}
+	for _, k := range prev {
+		if !inNext[string(k)] {
+			removes = append(removes, k)
+			inNext[string(k)] = true
+		}
+	}
+	return adds, removes
+}
 
-	if len(oldots) >= 8 {
+// Mutate loads the document with primary key pk, changes it with fn and writes it back with Update.
+// if another write got in between, it starts over with the new document
+// as often as the RetryPolicy of opts allows. fn may be called multiple times and must not have side effects.
+// if fn returns an error, nothing is written and the error is returned.
+func Mutate[Val any](ctx context.Context, DB *DB, pk any, fn func(*Val) error, opts ...Opt) (Val, error) {
+	policy := DB.retryPolicy(opts)
 
-		path := []byte{'o', 0xff, oldots[0], oldots[1], oldots[2], oldots[3], oldots[4], oldots[5], oldots[6], oldots[7], 0xff}
-		oldb, err := DB.KV.Get(ctx, path)
+	for n := 1; ; n++ {
+		var val Val
+		doc := &StoredDocument{Val: &val}
+		err := DB.GetByPK(ctx, doc, pk)
 		if err != nil {
-			return nil
+			return val, err
 		}
 
-		if old == nil {
-			old = &StoredDocument{}
+		before, err := getPKFromAny(doc)
+		if err != nil {
+			return val, err
 		}
-		if !strings.HasPrefix(reflect.TypeOf(old).String(), "kane.StoredDocument") && !strings.HasPrefix(reflect.TypeOf(old).String(), "*kane.StoredDocument") {
-			old = &StoredDocument{Val: old}
+
+		err = fn(&val)
+		if err != nil {
+			return val, err
 		}
 
-		err = deserializeStore(oldb, old)
-		if err == nil {
-			DB.index(ctx, old.(*StoredDocument), []byte(model), oldots[:], false)
-			DB.KV.Del(ctx, path)
+		after, err := getPKFromAny(doc)
+		if err != nil {
+			return val, err
+		}
+		if !bytes.Equal(before, after) {
+			return val, docError(fmt.Errorf("%w: Mutate cannot change the primary key", ErrInvalidKey), getModelFromAny(doc), pk)
 		}
-	}
 
-	return nil
+		err = DB.Update(ctx, doc, doc.Version)
+		if !errors.Is(err, ErrConflict) {
+			return val, err
+		}
+
+		again, rerr := DB.retry(ctx, policy, n)
+		if rerr != nil {
+			return val, rerr
+		}
+		if !again {
+			return val, err
+		}
+	}
 }
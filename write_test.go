@@ -1,10 +1,18 @@
 package kane
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/aep/kane/kv"
 )
 
 type WriteTestDoc struct {
@@ -16,6 +24,96 @@ func (d *WriteTestDoc) PK() any {
 	return d.ID
 }
 
+// countingKV counts the writes that go through it
+type countingKV struct {
+	kv.KV
+	sets int
+	dels int
+}
+
+func (c *countingKV) Set(ctx context.Context, key []byte, value []byte, opts ...kv.Opt) error {
+	c.sets++
+	return c.KV.Set(ctx, key, value, opts...)
+}
+
+func (c *countingKV) Del(ctx context.Context, key []byte, opts ...kv.Opt) error {
+	c.dels++
+	return c.KV.Del(ctx, key, opts...)
+}
+
+// indexHookKV calls onIndex before the first write of an index key that goes through it,
+// to stall or fail a write at that point
+type indexHookKV struct {
+	kv.KV
+	once    sync.Once
+	onIndex func() error
+}
+
+func (h *indexHookKV) Set(ctx context.Context, key []byte, value []byte, opts ...kv.Opt) error {
+	var err error
+	if key[0] == 'f' {
+		h.once.Do(func() { err = h.onIndex() })
+	}
+	if err != nil {
+		return err
+	}
+	return h.KV.Set(ctx, key, value, opts...)
+}
+
+// holdLock makes it look like a write of doc holds the lock of its primary key since at,
+// and returns a function that releases it
+func holdLock(t *testing.T, db *DB, doc *WriteTestDoc, at time.Time) func() {
+	ctx := context.Background()
+	pk, _ := getPKFromAny(doc)
+	pkpath := append([]byte("k\xffWriteTestDoc\xff"), pk...)
+	pkpath = append(pkpath, 0xff)
+
+	ptr, err := db.KV.Get(ctx, pkpath)
+	if err != nil {
+		t.Fatalf("Failed to read pointer: %v", err)
+	}
+	oid := ptr[:8]
+
+	err = db.KV.Set(ctx, pkpath, binary.LittleEndian.AppendUint64(bytes.Clone(oid), uint64(at.UnixMilli())<<18))
+	if err != nil {
+		t.Fatalf("Failed to lock pointer: %v", err)
+	}
+	return func() {
+		db.KV.Set(ctx, pkpath, oid)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for n, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if d := p.delay(n + 1); d != want*time.Millisecond {
+			t.Errorf("Expected delay %d to be %v, got %v", n+1, want*time.Millisecond, d)
+		}
+	}
+	if d := p.delay(1000); d != p.MaxDelay {
+		t.Errorf("Expected delay to stay at %v, got %v", p.MaxDelay, d)
+	}
+
+	p.MaxDelay = 0
+	if d := p.delay(5); d != p.BaseDelay {
+		t.Errorf("Expected delay to stay at %v without MaxDelay, got %v", p.BaseDelay, d)
+	}
+
+	// only MaxAttempts set must still wait between attempts
+	p = (&DB{}).retryPolicy([]Opt{Retry(RetryPolicy{MaxAttempts: 5})})
+	if p.MaxAttempts != 5 || p.BaseDelay != DefaultRetryPolicy.BaseDelay || p.MaxDelay != DefaultRetryPolicy.MaxDelay {
+		t.Errorf("Expected unset fields from DefaultRetryPolicy, got %+v", p)
+	}
+
+	p = DefaultRetryPolicy
+	for i := 0; i < 100; i++ {
+		d := p.delay(1)
+		if d < p.BaseDelay/2 || d >= p.BaseDelay*3/2 {
+			t.Fatalf("Expected jittered delay around %v, got %v", p.BaseDelay, d)
+		}
+	}
+}
+
 func TestWriteOperations(t *testing.T) {
 	runTests := func(t *testing.T, db *DB) {
 		ctx := context.Background()
@@ -42,8 +140,8 @@ func TestWriteOperations(t *testing.T) {
 			// Attempt to create a document with same key
 			duplicateDoc := &WriteTestDoc{ID: "write-test-1", Value: "Duplicate Value"}
 			err = db.Put(ctx, duplicateDoc)
-			if err == nil {
-				t.Error("Expected error when putting document with existing key, got nil")
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict when putting document with existing key, got %v", err)
 			}
 
 			// Clean up
@@ -109,6 +207,208 @@ func TestWriteOperations(t *testing.T) {
 			}
 		})
 
+		t.Run("History", func(t *testing.T) {
+			doc := &WriteTestDoc{ID: "write-test-history", Value: "Initial Value"}
+			err := db.Put(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+
+			first := &StoredDocument{Val: &WriteTestDoc{}}
+			err = db.Get(ctx, first, Eq("ID", "write-test-history"))
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if first.History == nil || first.History.Created == nil || first.History.Updated == nil {
+				t.Fatalf("Expected history to be set, got %+v", first.History)
+			}
+			if !first.History.Created.Equal(*first.History.Updated) {
+				t.Errorf("Expected created and updated to be equal on insert, got %v and %v", first.History.Created, first.History.Updated)
+			}
+			if d := time.Since(*first.History.Created); d < -time.Minute || d > time.Minute {
+				t.Errorf("Expected created to be now, got %v", first.History.Created)
+			}
+
+			// let the clock move on, history has millisecond precision
+			time.Sleep(5 * time.Millisecond)
+
+			err = db.Set(ctx, &WriteTestDoc{ID: "write-test-history", Value: "Updated Value"})
+			if err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+
+			second := &StoredDocument{Val: &WriteTestDoc{}}
+			err = db.Get(ctx, second, Eq("ID", "write-test-history"))
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if second.History == nil || second.History.Created == nil || second.History.Updated == nil {
+				t.Fatalf("Expected history to be set, got %+v", second.History)
+			}
+			if !second.History.Created.Equal(*first.History.Created) {
+				t.Errorf("Expected created to be carried forward, got %v, want %v", second.History.Created, first.History.Created)
+			}
+			if !second.History.Updated.After(*first.History.Updated) {
+				t.Errorf("Expected updated to move forward, got %v after %v", second.History.Updated, first.History.Updated)
+			}
+
+			// concurrent writers all carry forward the same creation time
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					err := db.Set(ctx, &WriteTestDoc{ID: "write-test-history", Value: fmt.Sprintf("Value %d", i)})
+					if err != nil {
+						t.Errorf("Failed to set document: %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			third := &StoredDocument{Val: &WriteTestDoc{}}
+			err = db.Get(ctx, third, Eq("ID", "write-test-history"))
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if third.History == nil || third.History.Created == nil || !third.History.Created.Equal(*first.History.Created) {
+				t.Errorf("Expected created to be carried forward, got %+v, want %v", third.History, first.History.Created)
+			}
+
+			err = db.Del(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+		})
+
+		t.Run("Update", func(t *testing.T) {
+			doc := &WriteTestDoc{ID: "write-test-update", Value: "Initial Value"}
+			err := db.Put(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+
+			read := &StoredDocument{Val: &WriteTestDoc{}}
+			err = db.Get(ctx, read, Eq("ID", "write-test-update"))
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if read.Version == 0 {
+				t.Fatal("Expected version to be set")
+			}
+
+			// Update at the version that was read
+			update := &StoredDocument{Val: &WriteTestDoc{ID: "write-test-update", Value: "Updated Value"}}
+			err = db.Update(ctx, update, read.Version)
+			if err != nil {
+				t.Fatalf("Failed to update document: %v", err)
+			}
+			if update.Version == 0 || update.Version == read.Version {
+				t.Errorf("Expected a new version, got %d after %d", update.Version, read.Version)
+			}
+
+			// A second update at the old version conflicts and leaves no trace
+			err = db.Update(ctx, &WriteTestDoc{ID: "write-test-update", Value: "Lost Value"}, read.Version)
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict for outdated version, got %v", err)
+			}
+			n, err := db.Count(ctx, WriteTestDoc{}, Eq("ID", "write-test-update"))
+			if err != nil || n != 1 {
+				t.Errorf("Expected 1 indexed document after conflict, got %d, %v", n, err)
+			}
+
+			current := &StoredDocument{Val: &WriteTestDoc{}}
+			err = db.GetByPK(ctx, current, "write-test-update")
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if current.Version != update.Version || current.Val.(*WriteTestDoc).Value != "Updated Value" {
+				t.Errorf("Expected the updated document at version %d, got %+v at %d", update.Version, current.Val, current.Version)
+			}
+
+			// Updating a document that does not exist
+			err = db.Update(ctx, &WriteTestDoc{ID: "write-test-update-missing"}, read.Version)
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for missing document, got %v", err)
+			}
+
+			err = db.Del(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+		})
+
+		t.Run("Mutate", func(t *testing.T) {
+			doc := &WriteTestDoc{ID: "write-test-mutate", Value: ""}
+			err := db.Put(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+
+			// concurrent appends all make it
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := Mutate(ctx, db, "write-test-mutate", func(doc *WriteTestDoc) error {
+						doc.Value += "x"
+						return nil
+					})
+					if err != nil {
+						t.Errorf("Failed to mutate document: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			got, err := GetPK[WriteTestDoc](ctx, db, "write-test-mutate")
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if got.Value != "xxxxxxxxxx" {
+				t.Errorf("Expected 10 appends, got %q", got.Value)
+			}
+
+			// errors from the callback abort without writing
+			abort := errors.New("abort")
+			_, err = Mutate(ctx, db, "write-test-mutate", func(doc *WriteTestDoc) error {
+				doc.Value = "aborted"
+				return abort
+			})
+			if !errors.Is(err, abort) {
+				t.Errorf("Expected callback error, got %v", err)
+			}
+
+			_, err = Mutate(ctx, db, "write-test-mutate", func(doc *WriteTestDoc) error {
+				doc.ID = "write-test-mutate-moved"
+				return nil
+			})
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("Expected ErrInvalidKey when changing the primary key, got %v", err)
+			}
+
+			got, err = GetPK[WriteTestDoc](ctx, db, "write-test-mutate")
+			if err != nil {
+				t.Fatalf("Failed to retrieve document: %v", err)
+			}
+			if got.Value != "xxxxxxxxxx" {
+				t.Errorf("Expected document to be unchanged, got %q", got.Value)
+			}
+
+			_, err = Mutate(ctx, db, "write-test-mutate-missing", func(doc *WriteTestDoc) error {
+				return nil
+			})
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for missing document, got %v", err)
+			}
+
+			err = db.Del(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+		})
+
 		t.Run("Swap", func(t *testing.T) {
 			// Create a document
 			doc := &WriteTestDoc{ID: "write-test-4", Value: "Swap Original"}
@@ -148,6 +448,240 @@ func TestWriteOperations(t *testing.T) {
 			}
 		})
 
+		t.Run("Diff", func(t *testing.T) {
+			counted := &countingKV{KV: db.KV}
+			cdb := &DB{KV: counted}
+
+			doc := &WriteTestDoc{ID: "write-test-diff", Value: "a"}
+			err := cdb.Put(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+
+			// Only the changed field is reindexed, the object is overwritten in place
+			counted.sets, counted.dels = 0, 0
+			doc.Value = "b"
+			err = cdb.Set(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+			if counted.sets != 2 || counted.dels != 1 {
+				t.Errorf("Expected 2 sets and 1 delete, got %d sets and %d deletes", counted.sets, counted.dels)
+			}
+
+			counted.sets, counted.dels = 0, 0
+			err = cdb.Set(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to set document: %v", err)
+			}
+			if counted.sets != 1 || counted.dels != 0 {
+				t.Errorf("Expected 1 set and no deletes, got %d sets and %d deletes", counted.sets, counted.dels)
+			}
+
+			for _, tc := range []struct {
+				op   Filter
+				want int
+			}{
+				{Eq("Value", "a"), 0},
+				{Eq("Value", "b"), 1},
+				{Eq("ID", doc.ID), 1},
+			} {
+				n, err := db.Count(ctx, WriteTestDoc{}, tc.op)
+				if err != nil {
+					t.Fatalf("Failed to count: %v", err)
+				}
+				if n != tc.want {
+					t.Errorf("Expected count %d, got %d", tc.want, n)
+				}
+			}
+
+			// Concurrent writes leave exactly the last value indexed
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					err := db.Set(ctx, &WriteTestDoc{ID: doc.ID, Value: fmt.Sprint(i)})
+					if err != nil {
+						t.Errorf("Failed to set document: %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			got, err := GetPK[WriteTestDoc](ctx, db, doc.ID)
+			if err != nil {
+				t.Fatalf("Failed to get document: %v", err)
+			}
+			n, err := db.Count(ctx, WriteTestDoc{}, And(Eq("ID", doc.ID), Has("Value")))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			m, err := db.Count(ctx, WriteTestDoc{}, Eq("Value", got.Value))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if n != 1 || m != 1 {
+				t.Errorf("Expected one index entry for %q, got %d and %d", got.Value, n, m)
+			}
+
+			// A write that crashed while holding the lock blocks others until the lock expires
+			holdLock(t, db, doc, time.Now())
+			current := &StoredDocument{Val: &WriteTestDoc{}}
+			err = db.GetByPK(ctx, current, doc.ID)
+			if err != nil {
+				t.Fatalf("Failed to get locked document: %v", err)
+			}
+			err = db.Update(ctx, doc, current.Version)
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict while locked, got %v", err)
+			}
+
+			// the crashed write also removed an index key that is still needed
+			for h, err := range db.find(ctx, "WriteTestDoc", nil, Eq("Value", got.Value), queryOpts{}, nil) {
+				if err != nil {
+					t.Fatalf("Failed to find document: %v", err)
+				}
+				if err := db.KV.Del(ctx, h.key); err != nil {
+					t.Fatalf("Failed to delete index key: %v", err)
+				}
+			}
+
+			holdLock(t, db, doc, time.Now().Add(-DefaultWriteLockTimeout))
+			doc.Value = "c"
+			err = db.Update(ctx, doc, current.Version)
+			if err != nil {
+				t.Fatalf("Failed to take over expired lock: %v", err)
+			}
+			for _, tc := range []struct {
+				op   Filter
+				want int
+			}{
+				{Eq("Value", got.Value), 0},
+				{Eq("Value", "c"), 1},
+				{Eq("ID", doc.ID), 1},
+			} {
+				n, err := db.Count(ctx, WriteTestDoc{}, tc.op)
+				if err != nil {
+					t.Fatalf("Failed to count: %v", err)
+				}
+				if n != tc.want {
+					t.Errorf("Expected count %d, got %d", tc.want, n)
+				}
+			}
+
+			err = db.Del(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+			n, err = db.Count(ctx, WriteTestDoc{}, Eq("ID", doc.ID))
+			if err != nil || n != 0 {
+				t.Errorf("Expected no index entries after delete, got %d %v", n, err)
+			}
+		})
+
+		t.Run("Retry", func(t *testing.T) {
+			doc := &WriteTestDoc{ID: "write-test-retry", Value: "a"}
+			err := db.Put(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+
+			// Give up after MaxAttempts while another write holds the lock
+			unlock := holdLock(t, db, doc, time.Now())
+			before := db.Stats()
+			fast := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+			err = db.Set(ctx, doc, Retry(fast))
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict after 3 attempts, got %v", err)
+			}
+			_, err = Mutate(ctx, db, doc.ID, func(doc *WriteTestDoc) error {
+				doc.Value = "b"
+				return nil
+			}, Retry(RetryPolicy{MaxAttempts: 1}))
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict without retries, got %v", err)
+			}
+
+			after := db.Stats()
+			if after.Conflicts-before.Conflicts != 4 || after.Retries-before.Retries != 2 || after.GaveUp-before.GaveUp != 2 {
+				t.Errorf("Expected 4 conflicts, 2 retries and 2 given up, got %+v", after)
+			}
+
+			// The DB policy applies to writes without the option
+			db.RetryPolicy = &RetryPolicy{MaxAttempts: 2}
+			err = db.Del(ctx, doc)
+			db.RetryPolicy = nil
+			if !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict from the DB policy, got %v", err)
+			}
+
+			// Retry until the lock is released
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				unlock()
+			}()
+			doc.Value = "c"
+			err = db.Set(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to set document after the lock was released: %v", err)
+			}
+
+			err = db.Del(ctx, doc)
+			if err != nil {
+				t.Fatalf("Failed to delete document: %v", err)
+			}
+		})
+
+		t.Run("Fence", func(t *testing.T) {
+			timeout := 300 * time.Millisecond
+			other := &DB{KV: db.KV, WriteLockTimeout: timeout}
+
+			doc := &WriteTestDoc{ID: "write-test-fence", Value: "a"}
+			if err := db.Put(ctx, doc); err != nil {
+				t.Fatalf("Failed to put document: %v", err)
+			}
+
+			// a write that stalls past the timeout must not overwrite the write that took over its lock
+			stalled := &DB{KV: &indexHookKV{KV: db.KV, onIndex: func() error {
+				time.Sleep(timeout + 100*time.Millisecond)
+				return nil
+			}}, WriteLockTimeout: timeout}
+
+			done := make(chan error)
+			go func() {
+				done <- stalled.Set(ctx, &WriteTestDoc{ID: doc.ID, Value: "b"})
+			}()
+			time.Sleep(timeout + 50*time.Millisecond)
+			if err := other.Set(ctx, &WriteTestDoc{ID: doc.ID, Value: "c"}); err != nil {
+				t.Fatalf("Failed to take over expired lock: %v", err)
+			}
+			if err := <-done; !errors.Is(err, ErrConflict) {
+				t.Errorf("Expected ErrConflict for the stalled write, got %v", err)
+			}
+
+			got, err := GetPK[WriteTestDoc](ctx, db, doc.ID)
+			if err != nil || got.Value != "c" {
+				t.Errorf("Expected the write that took over to win, got %v %v", got, err)
+			}
+			if err := db.Get(ctx, &got, Eq("Value", "c")); err != nil {
+				t.Errorf("Expected index key of the winning write, got %v", err)
+			}
+
+			// a create that fails at its index keys leaves no document without them behind
+			failing := &DB{KV: &indexHookKV{KV: db.KV, onIndex: func() error {
+				return errors.New("crash")
+			}}}
+			if err := failing.Put(ctx, &WriteTestDoc{ID: "write-test-crash", Value: "x"}); err == nil {
+				t.Fatalf("Expected the create to fail")
+			}
+			if _, err := GetPK[WriteTestDoc](ctx, db, "write-test-crash"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected no document after a failed create, got %v", err)
+			}
+
+			db.Del(ctx, doc)
+		})
+
 		t.Run("Del", func(t *testing.T) {
 			// Create a document
 			doc := &WriteTestDoc{ID: "write-test-5", Value: "Delete Me"}
@@ -171,8 +705,8 @@ func TestWriteOperations(t *testing.T) {
 
 			// Verify it was deleted
 			err = db.Get(ctx, retrievedDoc, Eq("ID", "write-test-5"))
-			if err == nil {
-				t.Error("Expected error when getting deleted document, got nil")
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound when getting deleted document, got %v", err)
 			}
 
 			// Delete a non-existent document